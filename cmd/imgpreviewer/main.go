@@ -3,10 +3,15 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,6 +20,8 @@ import (
 	"github.com/yakuninmax/imgpreviewer/internal/config"
 	"github.com/yakuninmax/imgpreviewer/internal/downloader"
 	"github.com/yakuninmax/imgpreviewer/internal/logger"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+	"github.com/yakuninmax/imgpreviewer/internal/peer"
 	"github.com/yakuninmax/imgpreviewer/internal/server"
 	"github.com/yakuninmax/imgpreviewer/internal/storage"
 )
@@ -31,28 +38,67 @@ func main() {
 		os.Exit(1)
 	}
 
-	store, err := storage.New(conf.CachePath())
+	reg := metrics.NewRegistry()
+
+	// Background jobs context.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	previews, closePreviews, err := newCache(ctx, logg, conf, reg, "previews", cacheLimits{
+		size:     conf.CacheSize(),
+		maxFiles: conf.CacheMaxFiles(),
+		memory:   conf.CacheMemorySize(),
+	})
 	if err != nil {
 		logg.Error(err.Error())
 		os.Exit(1)
 	}
-	defer func() {
-		err := store.Clean()
-		if err != nil {
-			logg.Error(err.Error())
-			os.Exit(1)
-		}
-		logg.Info("cache cleared")
-	}()
-	logg.Info("temp cache folder is " + conf.CachePath())
+	defer closePreviews()
 
-	cache := cache.New(conf.CacheSize(), store)
+	sources, closeSources, err := newCache(ctx, logg, conf, reg, "sources", cacheLimits{
+		size:     conf.SourceCacheSize(),
+		maxFiles: conf.SourceCacheMaxFiles(),
+		memory:   conf.SourceCacheMemorySize(),
+	})
+	if err != nil {
+		logg.Error(err.Error())
+		os.Exit(1)
+	}
+	defer closeSources()
+
+	cc := conf.Client()
+	dl := downloader.New(downloader.Options{
+		RequestTimeout:        conf.RequestTimeout(),
+		DialTimeout:           cc.DialTimeout,
+		TLSHandshakeTimeout:   cc.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cc.ResponseHeaderTimeout,
+		KeepAlive:             cc.KeepAlive,
+		IdleConnTimeout:       cc.IdleConnTimeout,
+		MaxIdleConnsPerHost:   cc.MaxIdleConnsPerHost,
+		HTTP2:                 cc.HTTP2,
+		Metrics:               reg,
+		MetricsHosts:          conf.MetricsHosts(),
+	})
 
-	dl := downloader.New(conf.RequestTimeout())
+	// Previews are rendered by owner replicas, if peers are set.
+	var peers *peer.Pool
+	if len(conf.Peers()) > 0 {
+		peers = peer.NewPool(conf.PeerSelf(), conf.Peers(), peer.Options{
+			Timeout: conf.RequestTimeout(),
+			Secret:  conf.PeerSecret(),
+			Metrics: reg,
+		})
+		logg.Info("peer replicas are " + strings.Join(conf.Peers(), ", "))
+	}
 
-	app := app.New(logg, cache, dl)
+	app := app.New(logg, previews, sources, dl, peers, conf.SourceTTL(), reg)
 
-	srv := server.New(conf.Port(), app, logg)
+	srv := server.New(conf.Port(), app, logg, server.Options{
+		ProxyErrors: conf.ProxyErrors(),
+		MaxAge:      conf.MaxAge(),
+		Metrics:     reg,
+		Peers:       peers,
+	})
 
 	go func() {
 		logg.Info("starting server")
@@ -65,6 +111,23 @@ func main() {
 		logg.Info("stopped serving new connections")
 	}()
 
+	// Admin API and metrics are served only if token is set.
+	var admin *server.Admin
+	if conf.AdminToken() != "" {
+		admin = server.NewAdmin(conf.AdminPort(), conf.AdminToken(), app, peers, logg, reg)
+
+		go func() {
+			logg.Info("starting admin server")
+			err := admin.Start()
+			if err != nil {
+				logg.Error(err.Error())
+				os.Exit(1)
+			}
+
+			logg.Info("admin server stopped serving new connections")
+		}()
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
@@ -72,9 +135,173 @@ func main() {
 	sctx, rctx := context.WithTimeout(context.Background(), 5*time.Second)
 	defer rctx()
 
+	if admin != nil {
+		if err := admin.Stop(sctx); err != nil {
+			logg.Error(err.Error())
+		}
+	}
+
 	if err := srv.Stop(sctx); err != nil {
 		logg.Error(err.Error())
 		panic(err.Error())
 	}
 	logg.Info("graceful shutdown complete")
 }
+
+// Cache size limits.
+type cacheLimits struct {
+	size     int64 // bytes
+	maxFiles int   // zero means unlimited
+	memory   int64 // memory layer bytes, zero means disabled
+}
+
+// Create cache in given cache subfolder, returns cache and its shutdown func.
+func newCache(
+	ctx context.Context, logg *logger.Logger, conf *config.Config, reg *metrics.Registry, dir string, limits cacheLimits,
+) (*cache.Cache, func(), error) {
+	policy, err := cache.NewPolicy(conf.CachePolicy(), limits.size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := []cache.Option{
+		cache.WithPolicy(policy),
+		cache.WithMaxFiles(limits.maxFiles),
+		cache.WithMaxAge(conf.CacheTTL()),
+		cache.WithIdleTimeout(conf.CacheIdleTimeout()),
+		cache.WithMetrics(reg, dir),
+		cache.WithErrorHandler(func(err error) {
+			logg.Error(dir + " cache: " + err.Error())
+		}),
+	}
+
+	// Hot files are kept in memory, if enabled.
+	if limits.memory > 0 {
+		memPolicy, err := cache.NewPolicy(conf.MemoryPolicy(), limits.memory)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		opts = append(opts, cache.WithMemory(limits.memory, memPolicy))
+	}
+
+	// Shared cache index is kept next to cache subfolder.
+	if conf.CacheShared() {
+		opts = append(opts, cache.WithShared(filepath.Join(conf.CachePath(), dir+".index")))
+	}
+
+	store, err := newStorage(conf, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := cache.New(limits.size, store, opts...)
+
+	// Temp cache is removed on shutdown, shared cache is used by other processes.
+	if !conf.CachePersistent() && !conf.CacheShared() {
+		logg.Info("temp " + dir + " cache storage is " + store.Path())
+
+		stopJanitor := runJanitor(ctx, logg, conf, c, dir, false)
+
+		return c, func() {
+			stopJanitor()
+
+			err := store.Clean()
+			if err != nil {
+				logg.Error(err.Error())
+				os.Exit(1)
+			}
+			logg.Info(dir + " cache cleared")
+		}, nil
+	}
+
+	// Persistent cache is restored on startup, and saved on shutdown.
+	err = c.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	logg.Info("persistent " + dir + " cache storage is " + store.Path())
+
+	// Janitor is started on loaded index, and stopped before index is saved.
+	stopJanitor := runJanitor(ctx, logg, conf, c, dir, true)
+
+	return c, func() {
+		stopJanitor()
+
+		err := errors.Join(c.Save(), c.Close())
+		if err != nil {
+			logg.Error(err.Error())
+			os.Exit(1)
+		}
+		logg.Info(dir + " cache saved")
+	}, nil
+}
+
+// Remove expired cache files in background, and save index of persistent cache,
+// so it survives unclean exit. Returns func that stops janitor and waits for it to exit.
+func runJanitor(
+	ctx context.Context, logg *logger.Logger, conf *config.Config, c *cache.Cache, dir string, save bool,
+) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		c.RunJanitor(ctx, conf.JanitorInterval(), func(err error) {
+			logg.Error("failed to remove expired " + dir + " cache files: " + err.Error())
+		})
+	}()
+
+	if save {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c.RunSaver(ctx, conf.JanitorInterval(), func(err error) {
+				logg.Error("failed to save " + dir + " cache index: " + err.Error())
+			})
+		}()
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Create configured cache storage backend in given cache subfolder.
+func newStorage(conf *config.Config, dir string) (cache.Storage, error) {
+	folder := filepath.Join(conf.CachePath(), dir)
+
+	// Shared cache storage must have the same path in all processes.
+	persistent := conf.CachePersistent() || conf.CacheShared()
+
+	switch conf.CacheStorage() {
+	case storage.BackendFS:
+		return storage.New(folder, persistent,
+			storage.WithSync(conf.CacheSync()), storage.WithFanOut(conf.CacheFanOut()))
+
+	case storage.BackendMemory:
+		return storage.NewMemory(), nil
+
+	case storage.BackendLog:
+		return storage.NewLog(folder, persistent, storage.LogOptions{Sync: conf.CacheSync()})
+
+	case storage.BackendS3:
+		s3 := conf.S3()
+
+		return storage.NewS3(storage.S3Options{
+			Endpoint:  s3.Endpoint,
+			Region:    s3.Region,
+			Bucket:    s3.Bucket,
+			Prefix:    path.Join(s3.Prefix, dir),
+			AccessKey: s3.AccessKey,
+			SecretKey: s3.SecretKey,
+			Timeout:   conf.RequestTimeout(),
+		}, persistent)
+	}
+
+	return nil, fmt.Errorf("%w: %s", storage.ErrUnknownBackend, conf.CacheStorage())
+}
@@ -2,18 +2,37 @@ package app
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/disintegration/imaging"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/downloader"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+	"github.com/yakuninmax/imgpreviewer/internal/peer"
+	"github.com/yakuninmax/imgpreviewer/internal/singleflight"
 )
 
+// Content type of rendered previews.
+const previewContentType = "image/jpeg"
+
 var (
-	ErrNotEnoughParameters = errors.New("not enough parameters")
-	ErrInvalidSize         = errors.New("target size is larger than original")
+	ErrNotEnoughParameters = apperror.New(apperror.BadRequest, "not enough parameters")
+	ErrInvalidParameters   = apperror.New(apperror.BadRequest, "width and height must be positive integers")
+	ErrInvalidSize         = apperror.New(apperror.Unprocessable, "target size is larger than original")
 )
 
 type logger interface {
@@ -23,32 +42,71 @@ type logger interface {
 	Debug(string)
 }
 
-type cache interface {
-	Get(uri string) ([]byte, error)
-	Put(uri string, data []byte) error
+type imageCache interface {
+	Get(ctx context.Context, uri string) ([]byte, cache.Meta, error)
+	Open(ctx context.Context, uri string) (io.ReadSeekCloser, cache.Meta, error)
+	Put(ctx context.Context, uri string, data []byte, meta cache.Meta) error
+	Stat(uri string) (cache.Meta, bool)
+	SetMeta(uri string, meta cache.Meta) bool
+	Delete(uri string) (bool, error)
+	DeleteFunc(match func(uri string) bool) (int, error)
+	Flush() (int, error)
+	Entries() []cache.Entry
+}
+
+type imageDownloader interface {
+	GetImage(ctx context.Context, url string, headers map[string][]string, v downloader.Validators) (*downloader.Image, error)
 }
 
-type downloader interface {
-	GetImage(url string, headers map[string][]string) ([]byte, error)
+// Rendered preview with its metadata. Cached preview is streamed from Content,
+// which must be closed, otherwise Data is set.
+type Preview struct {
+	Data    []byte
+	Content io.ReadSeekCloser
+	cache.Meta
+}
+
+// Original image with its metadata.
+type source struct {
+	data []byte
+	meta cache.Meta
 }
 
 type App struct {
 	logger     logger
-	cache      cache
-	downloader downloader
+	cache      imageCache // rendered previews
+	sources    imageCache // original images
+	downloader imageDownloader
+	peers      *peer.Pool                   // nil renders all previews locally
+	ttl        time.Duration                // default lifetime of original images
+	renders    singleflight.Group[*Preview] // in-flight renders by cache key and generation
+	downloads  singleflight.Group[*source]  // in-flight downloads by url, validators and generation
+	resizeTime *metrics.Histogram           // decode and resize duration
+	encodeTime *metrics.Histogram           // encode duration
+	purgeMu    sync.RWMutex                 // held for write by purges, and for read by cache puts
+	generation uint64                       // number of purges, results of earlier renders are not cached
 }
 
-// Init app.
-func New(logg logger, cache cache, dl downloader) *App {
+// Init app, nil registry disables instrumentation.
+func New(
+	logg logger, previews, sources imageCache, dl imageDownloader, peers *peer.Pool, ttl time.Duration, reg *metrics.Registry,
+) *App {
 	return &App{
 		logger:     logg,
-		cache:      cache,
+		cache:      previews,
+		sources:    sources,
 		downloader: dl,
+		peers:      peers,
+		ttl:        ttl,
+		resizeTime: reg.Histogram("imgpreviewer_resize_duration_seconds",
+			"Image decode and resize duration in seconds.", metrics.DurationBuckets),
+		encodeTime: reg.Histogram("imgpreviewer_encode_duration_seconds",
+			"Preview encode duration in seconds.", metrics.DurationBuckets),
 	}
 }
 
 // Process resize request.
-func (a *App) Fill(ws, hs, url string, hdr map[string][]string) ([]byte, error) {
+func (a *App) Fill(ctx context.Context, ws, hs, url string, hdr map[string][]string) (*Preview, error) {
 	// Get request parameters.
 	wi, hi, url, err := getParameters(ws, hs, url)
 	if err != nil {
@@ -58,70 +116,380 @@ func (a *App) Fill(ws, hs, url string, hdr map[string][]string) ([]byte, error)
 	// Get image cache key
 	ck := getCacheKey(wi, hi, url)
 
-	// Get image.
-	b, cached, err := a.getImage(ck, url, hdr)
+	hdr, fromPeer := a.peers.Trusted(hdr)
+
+	// Stream fresh cached preview.
+	if meta, exists := a.cache.Stat(ck); exists && meta.IsFresh(time.Now()) {
+		content, meta, err := a.cache.Open(ctx, ck)
+		if err != nil {
+			return nil, apperror.Wrap(apperror.Internal, err)
+		}
+
+		if content != nil {
+			a.logger.Debug("image " + url + " found in cache")
+			return &Preview{Content: content, Meta: meta}, nil
+		}
+	}
+
+	// Render preview once for all concurrent requests, requests after purge
+	// do not wait for earlier render.
+	gen := a.getGeneration()
+
+	return a.renders.Do(ctx, ck+"\n"+strconv.FormatUint(gen, 10), func(ctx context.Context) (*Preview, error) {
+		// Preview is rendered by owner replica, request from other replica is processed locally.
+		if owner, remote := a.peers.Owner(ck); remote && !fromPeer {
+			preview, err := a.fetch(ctx, owner, wi, hi, url, hdr)
+			if !errors.Is(err, peer.ErrUnavailable) {
+				return preview, err
+			}
+
+			a.logger.Warn("failed to get image " + url + " from owner replica, render it locally: " + err.Error())
+		}
+
+		return a.render(ctx, gen, ck, wi, hi, url, hdr)
+	})
+}
+
+// Get preview from owner replica.
+func (a *App) fetch(ctx context.Context, owner string, wi, hi int, url string, hdr map[string][]string) (*Preview, error) {
+	path := fmt.Sprintf("/fill/%d/%d/%s", wi, hi, strings.TrimPrefix(url, "http://"))
+
+	data, meta, err := a.peers.Fetch(ctx, owner, path, hdr)
 	if err != nil {
 		return nil, err
 	}
 
-	// Bytes to image.
-	img, _, err := image.Decode(bytes.NewReader(b))
+	a.logger.Debug("image " + url + " received from owner replica " + owner)
+
+	return &Preview{Data: data, Meta: meta}, nil
+}
+
+// Get cached preview metadata, returns nil if preview is not cached.
+func (a *App) Stat(ws, hs, url string) (*Preview, error) {
+	// Get request parameters.
+	wi, hi, url, err := getParameters(ws, hs, url)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if destination size is larger than original.
-	if wi > img.Bounds().Dx() || hi > img.Bounds().Dy() {
-		return nil, ErrInvalidSize
+	// Expired preview must be revalidated.
+	meta, exists := a.cache.Stat(getCacheKey(wi, hi, url))
+	if !exists || !meta.IsFresh(time.Now()) {
+		return nil, nil
 	}
 
-	// Resize image.
-	img = imaging.Fill(img, wi, hi, imaging.Center, imaging.Lanczos)
+	return &Preview{Meta: meta}, nil
+}
 
-	// Image to bytes.
-	buf := new(bytes.Buffer)
-	err = jpeg.Encode(buf, img, nil)
-	if err != nil {
-		return nil, err
+// List cached previews and original images.
+func (a *App) Entries() ([]cache.Entry, []cache.Entry) {
+	return a.cache.Entries(), a.sources.Entries()
+}
+
+// Remove preview or original image by exact cache key, returns number of removed files.
+func (a *App) PurgeKey(key string) (int, error) {
+	defer a.beginPurge()()
+
+	removed := 0
+
+	for _, c := range []imageCache{a.cache, a.sources} {
+		deleted, err := c.Delete(key)
+		if err != nil {
+			return removed, apperror.Wrap(apperror.Internal, err)
+		}
+
+		if deleted {
+			removed++
+		}
 	}
 
-	// Put image to cache if it not from cache.
-	if !cached {
-		err = a.cache.Put(ck, buf.Bytes())
+	return removed, nil
+}
+
+// Remove original image and all its previews, returns number of removed files.
+func (a *App) PurgeURL(u string) (int, error) {
+	u = normalizeURL(u)
+
+	return a.purge(func(src string) bool { return src == u })
+}
+
+// Remove original images with url prefix and their previews, returns number of removed files.
+func (a *App) PurgePrefix(prefix string) (int, error) {
+	prefix = normalizeURL(prefix)
+
+	return a.purge(func(src string) bool { return strings.HasPrefix(src, prefix) })
+}
+
+// Remove original images from host and their previews, returns number of removed files.
+func (a *App) PurgeHost(host string) (int, error) {
+	return a.purge(func(src string) bool {
+		u, err := url.Parse(src)
 		if err != nil {
-			return nil, err
+			return false
 		}
 
-		a.logger.Debug("image " + url + " saved to cache")
+		return strings.EqualFold(u.Host, host) || strings.EqualFold(u.Hostname(), host)
+	})
+}
+
+// Remove all cached files, returns number of removed files.
+func (a *App) Flush() (int, error) {
+	defer a.beginPurge()()
+
+	removed := 0
+
+	for _, c := range []imageCache{a.cache, a.sources} {
+		n, err := c.Flush()
+		removed += n
+		if err != nil {
+			return removed, apperror.Wrap(apperror.Internal, err)
+		}
 	}
 
-	return buf.Bytes(), nil
+	return removed, nil
+}
+
+// Remove previews and original images with matching original url.
+func (a *App) purge(match func(url string) bool) (int, error) {
+	defer a.beginPurge()()
+
+	removed, err := a.cache.DeleteFunc(func(key string) bool {
+		src, ok := parseCacheKey(key)
+
+		return ok && match(src)
+	})
+	if err != nil {
+		return removed, apperror.Wrap(apperror.Internal, err)
+	}
+
+	n, err := a.sources.DeleteFunc(match)
+	removed += n
+	if err != nil {
+		return removed, apperror.Wrap(apperror.Internal, err)
+	}
+
+	return removed, nil
+}
+
+// Start purge, renders started before it don't cache their results. Returns
+// func, that ends purge.
+func (a *App) beginPurge() func() {
+	a.purgeMu.Lock()
+	a.generation++
+
+	return a.purgeMu.Unlock
+}
+
+func (a *App) getGeneration() uint64 {
+	a.purgeMu.RLock()
+	defer a.purgeMu.RUnlock()
+
+	return a.generation
+}
+
+// Put file to cache, unless it was purged after generation.
+func (a *App) put(ctx context.Context, c imageCache, gen uint64, key string, data []byte, meta cache.Meta) error {
+	a.purgeMu.RLock()
+	defer a.purgeMu.RUnlock()
+
+	if a.generation != gen {
+		return nil
+	}
+
+	return c.Put(ctx, key, data, meta)
 }
 
-// Get image.
-func (a *App) getImage(ck, url string, hdr map[string][]string) ([]byte, bool, error) {
+// Get preview from cache, or render it from original image. Rendered preview
+// is cached, if cache was not purged after given generation.
+func (a *App) render(
+	ctx context.Context, gen uint64, ck string, wi, hi int, url string, hdr map[string][]string,
+) (*Preview, error) {
 	// Search in cache.
-	data, err := a.cache.Get(ck)
+	data, meta, err := a.cache.Get(ctx, ck)
 	if err != nil {
-		return nil, false, err
+		return nil, apperror.Wrap(apperror.Internal, err)
 	}
 
-	// If image found in cache, return it.
+	// If image found in cache and it is fresh, return it as is.
 	if data != nil {
-		a.logger.Debug("image " + url + " found in cache")
-		return data, true, nil
+		if meta.IsFresh(time.Now()) {
+			a.logger.Debug("image " + url + " found in cache")
+			return &Preview{Data: data, Meta: meta}, nil
+		}
+
+		a.logger.Debug("image " + url + " found in cache, but expired")
+	} else {
+		a.logger.Debug("image " + url + " not found in cache")
 	}
 
-	a.logger.Debug("image " + url + " not found in cache, trying to download")
-	// If not found in cache, download image.
-	data, err = a.downloader.GetImage(url, hdr)
+	// Get original image, revalidated against cached preview origin.
+	src, err := a.getSource(ctx, gen, url, hdr, meta.Origin)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
-	a.logger.Debug("image " + url + " successfully downloaded")
+	// Original image is not changed, extend cached preview lifetime.
+	if data != nil && (src.data == nil || src.meta.Origin.Digest == meta.Origin.Digest) {
+		meta.Expires = src.meta.Expires
+		a.cache.SetMeta(ck, meta)
 
-	return data, false, nil
+		a.logger.Debug("image " + url + " is not modified")
+
+		return &Preview{Data: data, Meta: meta}, nil
+	}
+
+	// Resize image.
+	data, err = a.resize(ctx, src.data, wi, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	meta = cache.Meta{
+		ContentType: previewContentType,
+		ETag:        getETag(data),
+		ModTime:     time.Now().UTC().Truncate(time.Second),
+		Expires:     src.meta.Expires,
+		Origin:      src.meta.Origin,
+	}
+
+	// Put image to cache, preview larger than cache is served uncached.
+	err = a.put(ctx, a.cache, gen, ck, data, meta)
+	switch {
+	case errors.Is(err, cache.ErrFileToLarge):
+		a.logger.Warn("failed to save image " + url + " to cache: " + err.Error())
+	case err != nil:
+		return nil, apperror.Wrap(apperror.Internal, err)
+	default:
+		a.logger.Debug("image " + url + " saved to cache")
+	}
+
+	return &Preview{Data: data, Meta: meta}, nil
+}
+
+// Get original image from sources cache, or download it. If original image is
+// not cached, and remote server confirms given origin version, empty data is returned.
+func (a *App) getSource(
+	ctx context.Context, gen uint64, url string, hdr map[string][]string, origin cache.Origin,
+) (*source, error) {
+	// Search in sources cache.
+	data, meta, err := a.sources.Get(ctx, url)
+	if err != nil {
+		return nil, apperror.Wrap(apperror.Internal, err)
+	}
+
+	if data != nil {
+		if meta.IsFresh(time.Now()) {
+			a.logger.Debug("original image " + url + " found in cache")
+			return &source{data, meta}, nil
+		}
+
+		// Revalidate cached original.
+		origin = meta.Origin
+	}
+
+	// Download image once for all concurrent requests with the same validators.
+	key := url + "\n" + origin.ETag + "\n" + origin.LastModified + "\n" + strconv.FormatUint(gen, 10)
+
+	return a.downloads.Do(ctx, key, func(ctx context.Context) (*source, error) {
+		a.logger.Debug("original image " + url + " not found in cache or expired, trying to download")
+
+		img, err := a.downloader.GetImage(ctx, url, hdr, downloader.Validators{
+			ETag:         origin.ETag,
+			LastModified: origin.LastModified,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Use default lifetime, if remote server gave no info.
+		expires := img.Expires
+		if expires.IsZero() {
+			expires = time.Now().Add(a.ttl)
+		}
+
+		// Original image is not changed.
+		if img.NotModified {
+			a.logger.Debug("original image " + url + " is not modified")
+
+			meta.Expires = expires
+			meta.Origin = origin
+
+			if data != nil {
+				a.sources.SetMeta(url, meta)
+			}
+
+			return &source{data, meta}, nil
+		}
+
+		a.logger.Debug("image " + url + " successfully downloaded")
+
+		digest := getETag(img.Data)
+		meta := cache.Meta{
+			ContentType: http.DetectContentType(img.Data),
+			ETag:        digest,
+			ModTime:     time.Now().UTC().Truncate(time.Second),
+			Expires:     expires,
+			Origin: cache.Origin{
+				ETag:         img.ETag,
+				LastModified: img.LastModified,
+				Digest:       digest,
+			},
+		}
+
+		// Put original image to cache, too large images are just not cached.
+		err = a.put(ctx, a.sources, gen, url, img.Data, meta)
+		if err != nil {
+			a.logger.Warn("failed to save original image " + url + " to cache: " + err.Error())
+		}
+
+		return &source{img.Data, meta}, nil
+	})
+}
+
+// Resize image to given size, stops between stages if context is done.
+func (a *App) resize(ctx context.Context, b []byte, wi, hi int) ([]byte, error) {
+	start := time.Now()
+
+	// Bytes to image.
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, apperror.Wrap(apperror.UnsupportedMedia, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Check if destination size is larger than original.
+	if wi > img.Bounds().Dx() || hi > img.Bounds().Dy() {
+		return nil, ErrInvalidSize
+	}
+
+	// Resize image.
+	img = imaging.Fill(img, wi, hi, imaging.Center, imaging.Lanczos)
+	a.resizeTime.Observe(time.Since(start).Seconds())
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Image to bytes.
+	start = time.Now()
+	buf := new(bytes.Buffer)
+	err = jpeg.Encode(buf, img, nil)
+	if err != nil {
+		return nil, apperror.Wrap(apperror.Internal, err)
+	}
+	a.encodeTime.Observe(time.Since(start).Seconds())
+
+	return buf.Bytes(), nil
+}
+
+// Get strong entity tag of image.
+func getETag(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
 }
 
 // Get image cache key.
@@ -129,6 +497,40 @@ func getCacheKey(wi, hi int, url string) string {
 	return fmt.Sprintf("%d-%d-%s", wi, hi, url)
 }
 
+// Get original image url from preview cache key.
+func parseCacheKey(key string) (string, bool) {
+	parts := strings.SplitN(key, "-", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	return parts[2], true
+}
+
+// Replace url scheme with request handler one, url is cached under it
+// whatever scheme is given.
+func normalizeURL(u string) string {
+	if scheme, rest, found := strings.Cut(u, "://"); found && isScheme(scheme) {
+		u = rest
+	}
+
+	return "http://" + u
+}
+
+// Check if string is url scheme.
+func isScheme(s string) bool {
+	for i, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && ('0' <= r && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+
+	return s != ""
+}
+
 // Check request parameters.
 func getParameters(ws, hs, url string) (int, int, string, error) {
 	// Check if parameters are not empty.
@@ -138,14 +540,14 @@ func getParameters(ws, hs, url string) (int, int, string, error) {
 
 	// Get width.
 	wi, err := strconv.Atoi(ws)
-	if err != nil {
-		return 0, 0, "", err
+	if err != nil || wi <= 0 {
+		return 0, 0, "", ErrInvalidParameters
 	}
 
 	// Get heigth.
 	hi, err := strconv.Atoi(hs)
-	if err != nil {
-		return 0, 0, "", err
+	if err != nil || hi <= 0 {
+		return 0, 0, "", ErrInvalidParameters
 	}
 
 	// Add scheme to url.
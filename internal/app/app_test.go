@@ -0,0 +1,530 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/downloader"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+)
+
+// Logger, that discards messages.
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Error(string) {}
+func (nopLogger) Debug(string) {}
+
+// In-memory image cache.
+type fakeCache struct {
+	mu     sync.Mutex
+	files  map[string]source
+	puts   int
+	putErr error // if set, files are not put
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{files: make(map[string]source)}
+}
+
+func (c *fakeCache) Get(_ context.Context, key string) ([]byte, cache.Meta, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.files[key]
+
+	return f.data, f.meta, nil
+}
+
+func (c *fakeCache) Open(ctx context.Context, key string) (io.ReadSeekCloser, cache.Meta, error) {
+	data, meta, err := c.Get(ctx, key)
+	if data == nil || err != nil {
+		return nil, meta, err
+	}
+
+	return nopCloser{bytes.NewReader(data)}, meta, nil
+}
+
+func (c *fakeCache) Put(_ context.Context, key string, data []byte, meta cache.Meta) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.putErr != nil {
+		return c.putErr
+	}
+
+	c.files[key] = source{data, meta}
+	c.puts++
+
+	return nil
+}
+
+func (c *fakeCache) Stat(key string) (cache.Meta, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, exists := c.files[key]
+
+	return f.meta, exists
+}
+
+func (c *fakeCache) SetMeta(key string, meta cache.Meta) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, exists := c.files[key]
+	if exists {
+		c.files[key] = source{f.data, meta}
+	}
+
+	return exists
+}
+
+func (c *fakeCache) Delete(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, exists := c.files[key]
+	delete(c.files, key)
+
+	return exists, nil
+}
+
+func (c *fakeCache) DeleteFunc(match func(key string) bool) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key := range c.files {
+		if match(key) {
+			delete(c.files, key)
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func (c *fakeCache) Flush() (int, error) {
+	return c.DeleteFunc(func(string) bool { return true })
+}
+
+func (c *fakeCache) Entries() []cache.Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]cache.Entry, 0, len(c.files))
+	for key, f := range c.files {
+		entries = append(entries, cache.Entry{Key: key, Size: int64(len(f.data)), Meta: f.meta})
+	}
+
+	return entries
+}
+
+func (c *fakeCache) get(key string) source {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.files[key]
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Downloader, that counts requests and keeps their validators.
+type fakeDownloader struct {
+	mu         sync.Mutex
+	image      downloader.Image // response
+	err        error
+	release    chan struct{} // if set, requests wait for it to close
+	calls      int
+	validators []downloader.Validators
+}
+
+func (d *fakeDownloader) GetImage(
+	ctx context.Context, _ string, _ map[string][]string, v downloader.Validators,
+) (*downloader.Image, error) {
+	d.mu.Lock()
+	d.calls++
+	d.validators = append(d.validators, v)
+	img, err, release := d.image, d.err, d.release
+	d.mu.Unlock()
+
+	if release != nil {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &img, nil
+}
+
+func (d *fakeDownloader) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.calls
+}
+
+// Test app with fake caches and downloader.
+type testApp struct {
+	*App
+	previews *fakeCache
+	sources  *fakeCache
+	dl       *fakeDownloader
+	reg      *metrics.Registry
+}
+
+func newTestApp(t *testing.T, ttl time.Duration) *testApp {
+	t.Helper()
+
+	data, err := os.ReadFile("../../examples/gopher_256x126.jpg")
+	require.NoError(t, err)
+
+	ta := &testApp{
+		previews: newFakeCache(),
+		sources:  newFakeCache(),
+		dl:       &fakeDownloader{image: downloader.Image{Data: data}},
+		reg:      metrics.NewRegistry(),
+	}
+	ta.App = New(nopLogger{}, ta.previews, ta.sources, ta.dl, nil, ttl, ta.reg)
+
+	return ta
+}
+
+// Get number of resized images.
+func (ta *testApp) resizes(t *testing.T) string {
+	t.Helper()
+
+	out := &strings.Builder{}
+	_, err := ta.reg.WriteTo(out)
+	require.NoError(t, err)
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		if count, found := strings.CutPrefix(line, "imgpreviewer_resize_duration_seconds_count "); found {
+			return count
+		}
+	}
+
+	return "0"
+}
+
+func TestRevalidation(t *testing.T) {
+	ctx := context.Background()
+	url := "example.com/gopher.jpg"
+	src := "http://" + url
+	ck := getCacheKey(100, 50, src)
+
+	t.Run("stale source is reused if not modified", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		orig := ta.dl.image.Data
+
+		expires := time.Now().Add(time.Hour).Truncate(time.Second)
+		require.NoError(t, ta.sources.Put(ctx, src, orig, cache.Meta{
+			Expires: time.Now().Add(-time.Minute),
+			Origin:  cache.Origin{ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT", Digest: getETag(orig)},
+		}))
+		ta.dl.image = downloader.Image{NotModified: true, Expires: expires}
+
+		preview, err := ta.Fill(ctx, "100", "50", url, nil)
+		require.NoError(t, err)
+		require.NotEmpty(t, preview.Data)
+
+		// Cached original validators are sent.
+		require.Equal(t, []downloader.Validators{{ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}},
+			ta.dl.validators)
+
+		// Original lifetime is extended, its version is kept.
+		meta := ta.sources.get(src).meta
+		require.Equal(t, expires, meta.Expires)
+		require.Equal(t, `"v1"`, meta.Origin.ETag)
+		require.Equal(t, expires, preview.Expires)
+	})
+
+	t.Run("expired preview is kept if original is not modified", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+
+		expires := time.Now().Add(time.Hour).Truncate(time.Second)
+		require.NoError(t, ta.previews.Put(ctx, ck, []byte("preview"), cache.Meta{
+			ContentType: previewContentType,
+			Expires:     time.Now().Add(-time.Minute),
+			Origin:      cache.Origin{ETag: `"v1"`, Digest: "digest"},
+		}))
+		ta.dl.image = downloader.Image{NotModified: true, Expires: expires}
+
+		// Original is not cached, remote server confirms preview origin, nothing is downloaded.
+		src, err := ta.getSource(ctx, 0, "http://"+url, nil, cache.Origin{ETag: `"v1"`})
+		require.NoError(t, err)
+		require.Nil(t, src.data)
+
+		preview, err := ta.Fill(ctx, "100", "50", url, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("preview"), preview.Data)
+		require.Equal(t, expires, preview.Expires)
+		require.Equal(t, expires, ta.previews.get(ck).meta.Expires)
+		require.Equal(t, downloader.Validators{ETag: `"v1"`}, ta.dl.validators[1])
+		require.Equal(t, "0", ta.resizes(t))
+	})
+
+	t.Run("preview is compared by original digest", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		orig := ta.dl.image.Data
+
+		// Remote server ignores validators, but original is the same.
+		require.NoError(t, ta.previews.Put(ctx, ck, []byte("preview"), cache.Meta{
+			ContentType: previewContentType,
+			Expires:     time.Now().Add(-time.Minute),
+			Origin:      cache.Origin{ETag: `"v1"`, Digest: getETag(orig)},
+		}))
+
+		preview, err := ta.Fill(ctx, "100", "50", url, nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("preview"), preview.Data)
+		require.True(t, preview.IsFresh(time.Now()))
+		require.Equal(t, "0", ta.resizes(t))
+
+		// Original is changed, preview is rendered again.
+		require.NoError(t, ta.previews.Put(ctx, ck, []byte("preview"), cache.Meta{
+			ContentType: previewContentType,
+			Expires:     time.Now().Add(-time.Minute),
+			Origin:      cache.Origin{ETag: `"v1"`, Digest: "other"},
+		}))
+		_, _ = ta.sources.Flush()
+
+		preview, err = ta.Fill(ctx, "100", "50", url, nil)
+		require.NoError(t, err)
+		require.NotEqual(t, []byte("preview"), preview.Data)
+		require.Equal(t, getETag(orig), preview.Origin.Digest)
+		require.Equal(t, "1", ta.resizes(t))
+	})
+
+	t.Run("expires is propagated", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+
+		expires := time.Now().Add(time.Minute).Truncate(time.Second)
+		ta.dl.image.Expires = expires
+		ta.dl.image.Validators = downloader.Validators{ETag: `"v2"`}
+
+		preview, err := ta.Fill(ctx, "100", "50", url, nil)
+		require.NoError(t, err)
+		require.Equal(t, expires, preview.Expires)
+		require.Equal(t, expires, ta.previews.get(ck).meta.Expires)
+		require.Equal(t, expires, ta.sources.get(src).meta.Expires)
+		require.Equal(t, `"v2"`, ta.sources.get(src).meta.Origin.ETag)
+
+		// Default lifetime is used without remote server info.
+		ta = newTestApp(t, time.Hour)
+
+		preview, err = ta.Fill(ctx, "100", "50", url, nil)
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(time.Hour), preview.Expires, time.Minute)
+	})
+
+	t.Run("downloads are shared by url and validators", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		ta.dl.release = make(chan struct{})
+
+		origins := []cache.Origin{{ETag: `"v1"`}, {ETag: `"v1"`}, {ETag: `"v2"`}, {}}
+
+		var wg sync.WaitGroup
+		for _, origin := range origins {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				_, err := ta.getSource(ctx, 0, src, nil, origin)
+				require.NoError(t, err)
+			}()
+		}
+
+		// Requests with the same validators wait for the same download. Late
+		// request finds downloaded original in cache, so it is not counted either.
+		require.Eventually(t, func() bool { return ta.dl.count() == 3 }, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		close(ta.dl.release)
+		wg.Wait()
+
+		require.Equal(t, 3, ta.dl.count())
+	})
+}
+
+func TestOversizedPreview(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("preview larger than cache", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		ta.previews.putErr = cache.ErrFileToLarge
+
+		preview, err := ta.Fill(ctx, "100", "50", "example.com/image.jpg", nil)
+		require.NoError(t, err)
+		require.NotEmpty(t, preview.Data)
+		require.Empty(t, ta.previews.files)
+	})
+
+	t.Run("cache failure", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		ta.previews.putErr = errors.New("storage failure")
+
+		_, err := ta.Fill(ctx, "100", "50", "example.com/image.jpg", nil)
+		require.Equal(t, http.StatusInternalServerError, apperror.StatusCode(err))
+	})
+}
+
+func TestSourceCache(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestApp(t, time.Hour)
+
+	_, err := ta.Fill(ctx, "100", "50", "example.com/gopher.jpg", nil)
+	require.NoError(t, err)
+
+	// Other size is rendered from cached original.
+	preview, err := ta.Fill(ctx, "50", "50", "example.com/gopher.jpg", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, preview.Data)
+	require.Equal(t, 1, ta.dl.count())
+	require.Equal(t, "2", ta.resizes(t))
+	require.Equal(t, 1, ta.sources.puts)
+}
+
+func TestConcurrentFill(t *testing.T) {
+	ctx := context.Background()
+	ta := newTestApp(t, time.Hour)
+	ta.dl.release = make(chan struct{})
+
+	const requests = 10
+
+	previews := make([]*Preview, requests)
+
+	var wg sync.WaitGroup
+	for i := range previews {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			preview, err := ta.Fill(ctx, "100", "50", "example.com/gopher.jpg", nil)
+			require.NoError(t, err)
+
+			previews[i] = preview
+		}()
+	}
+
+	// Requests wait for the first download.
+	require.Eventually(t, func() bool { return ta.dl.count() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(ta.dl.release)
+	wg.Wait()
+
+	require.Equal(t, 1, ta.dl.count())
+	require.Equal(t, "1", ta.resizes(t))
+	require.Equal(t, 1, ta.previews.puts)
+
+	for _, preview := range previews {
+		if preview.Content != nil {
+			require.NoError(t, preview.Content.Close())
+			continue
+		}
+
+		require.Equal(t, previews[0].ETag, preview.ETag)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+
+	for _, u := range []string{
+		"example.com/gopher.jpg",
+		"http://example.com/gopher.jpg",
+		"https://example.com/gopher.jpg",
+		"HTTPS://example.com/gopher.jpg",
+	} {
+		t.Run(u, func(t *testing.T) {
+			ta := newTestApp(t, time.Hour)
+
+			_, err := ta.Fill(ctx, "100", "50", "example.com/gopher.jpg", nil)
+			require.NoError(t, err)
+
+			removed, err := ta.PurgeURL(u)
+			require.NoError(t, err)
+			require.Equal(t, 2, removed)
+			require.Empty(t, ta.previews.Entries())
+			require.Empty(t, ta.sources.Entries())
+		})
+	}
+
+	t.Run("in-flight render", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		ta.dl.release = make(chan struct{})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			preview, err := ta.Fill(ctx, "100", "50", "example.com/gopher.jpg", nil)
+			require.NoError(t, err)
+			require.NotEmpty(t, preview.Data)
+		}()
+
+		// Purge while original is downloaded.
+		require.Eventually(t, func() bool { return ta.dl.count() == 1 }, time.Second, time.Millisecond)
+		_, err := ta.PurgeURL("example.com/gopher.jpg")
+		require.NoError(t, err)
+
+		// Request after purge does not wait for earlier render.
+		next := make(chan struct{})
+		go func() {
+			defer close(next)
+
+			_, err := ta.Fill(ctx, "100", "50", "example.com/gopher.jpg", nil)
+			require.NoError(t, err)
+		}()
+		require.Eventually(t, func() bool { return ta.dl.count() == 2 }, time.Second, time.Millisecond)
+
+		close(ta.dl.release)
+		<-done
+		<-next
+
+		// Only render started after purge is cached.
+		require.Equal(t, 1, ta.previews.puts)
+		require.Equal(t, 1, ta.sources.puts)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+
+		_, err := ta.Fill(ctx, "100", "50", "example.com/a/gopher.jpg?from=http://other.com", nil)
+		require.NoError(t, err)
+
+		removed, err := ta.PurgePrefix("https://example.com/b/")
+		require.NoError(t, err)
+		require.Zero(t, removed)
+
+		removed, err = ta.PurgePrefix("https://example.com/a/")
+		require.NoError(t, err)
+		require.Equal(t, 2, removed)
+	})
+}
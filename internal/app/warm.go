@@ -0,0 +1,232 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+)
+
+// Preview path prefix in warm list urls.
+const fillPrefix = "/fill/"
+
+// Preview to render in advance.
+type WarmTarget struct {
+	Width  string
+	Height string
+	URL    string // original image url without scheme
+}
+
+func (t WarmTarget) String() string {
+	return t.Width + "/" + t.Height + "/" + t.URL
+}
+
+// Warm-up result.
+type WarmReport struct {
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Failures  []WarmFailure `json:"failures,omitempty"`
+}
+
+// Preview, that failed to render.
+type WarmFailure struct {
+	Target string `json:"target"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Sitemap document, its locations are preview urls.
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+// Parse warm list. It is either sitemap of preview urls, or text with
+// width/height/url line per preview. Lines may be preview paths or urls too,
+// empty lines and lines starting with # are skipped.
+func ParseWarmList(data []byte) ([]WarmTarget, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		return parseSitemap(data)
+	}
+
+	var targets []WarmTarget
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		t, ok := parseWarmTarget(line)
+		if !ok {
+			return nil, apperror.New(apperror.BadRequest, fmt.Sprintf("invalid warm list line %d: %s", n, line))
+		}
+
+		targets = append(targets, t)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, apperror.Wrap(apperror.BadRequest, fmt.Errorf("failed to read warm list: %w", err))
+	}
+
+	return targets, nil
+}
+
+// Parse sitemap of preview urls.
+func parseSitemap(data []byte) ([]WarmTarget, error) {
+	var sm sitemap
+
+	err := xml.Unmarshal(data, &sm)
+	if err != nil {
+		return nil, apperror.Wrap(apperror.BadRequest, fmt.Errorf("failed to parse sitemap: %w", err))
+	}
+
+	targets := make([]WarmTarget, 0, len(sm.URLs))
+	for _, u := range sm.URLs {
+		loc := strings.TrimSpace(u.Loc)
+
+		t, ok := parsePreviewURL(loc)
+		if !ok {
+			return nil, apperror.New(apperror.BadRequest, "invalid sitemap preview url: "+loc)
+		}
+
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// Parse preview url, preview path or width/height/url string. Original url in
+// width/height/url string may contain /fill/ too, so it is not searched for.
+func parseWarmTarget(s string) (WarmTarget, bool) {
+	if t, ok := parsePreviewURL(s); ok {
+		return t, true
+	}
+
+	if strings.HasPrefix(s, fillPrefix) || isPreviewURL(s) {
+		return WarmTarget{}, false
+	}
+
+	return splitTarget(strings.TrimPrefix(s, "/"))
+}
+
+// Parse preview url or path starting with /fill/.
+func parsePreviewURL(s string) (WarmTarget, bool) {
+	var path string
+
+	switch {
+	case strings.HasPrefix(s, fillPrefix):
+		// Preview path is escaped.
+		p, err := url.PathUnescape(s)
+		if err != nil {
+			return WarmTarget{}, false
+		}
+
+		path = p
+	case isPreviewURL(s):
+		u, err := url.Parse(s)
+		if err != nil {
+			return WarmTarget{}, false
+		}
+
+		path = u.Path
+	default:
+		return WarmTarget{}, false
+	}
+
+	rest, ok := strings.CutPrefix(path, fillPrefix)
+	if !ok {
+		return WarmTarget{}, false
+	}
+
+	return splitTarget(rest)
+}
+
+// Check if string is http or https url.
+func isPreviewURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// Split width/height/url string, original url scheme is removed.
+func splitTarget(s string) (WarmTarget, bool) {
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return WarmTarget{}, false
+	}
+
+	return WarmTarget{parts[0], parts[1], strings.TrimPrefix(normalizeURL(parts[2]), "http://")}, true
+}
+
+// Render previews into cache, at most concurrency at once.
+func (a *App) Warm(ctx context.Context, targets []WarmTarget, concurrency int) WarmReport {
+	errs := make([]error, len(targets))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(concurrency, 1); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				errs[i] = a.warm(ctx, targets[i])
+			}
+		}()
+	}
+
+	for i := range targets {
+		next <- i
+	}
+	close(next)
+
+	wg.Wait()
+
+	report := WarmReport{Total: len(targets)}
+	for i, err := range errs {
+		if err == nil {
+			report.Succeeded++
+			continue
+		}
+
+		report.Failed++
+		report.Failures = append(report.Failures, WarmFailure{
+			Target: targets[i].String(),
+			Status: apperror.StatusCode(err),
+			Error:  err.Error(),
+		})
+	}
+
+	a.logger.Info(fmt.Sprintf("warmed %d of %d previews", report.Succeeded, report.Total))
+
+	return report
+}
+
+// Render single preview into cache.
+func (a *App) warm(ctx context.Context, t WarmTarget) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	preview, err := a.Fill(ctx, t.Width, t.Height, t.URL, nil)
+	if err != nil {
+		a.logger.Warn("failed to warm image " + t.String() + ": " + err.Error())
+		return err
+	}
+
+	// Preview is already cached.
+	if preview.Content != nil {
+		return preview.Content.Close()
+	}
+
+	return nil
+}
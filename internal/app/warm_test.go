@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+)
+
+func TestParseWarmList(t *testing.T) {
+	t.Run("text list", func(t *testing.T) {
+		data := []byte(`# hero images
+300/200/example.com/hero.jpg
+
+/fill/100/100/example.com/thumb.jpg
+http://cdn.example.com/fill/50/50/example.com/a%20b.jpg
+640/480/http://example.com/big.jpg
+`)
+
+		targets, err := ParseWarmList(data)
+		require.NoError(t, err)
+		require.Equal(t, []WarmTarget{
+			{"300", "200", "example.com/hero.jpg"},
+			{"100", "100", "example.com/thumb.jpg"},
+			{"50", "50", "example.com/a b.jpg"},
+			{"640", "480", "example.com/big.jpg"},
+		}, targets)
+	})
+
+	t.Run("fill in original url", func(t *testing.T) {
+		data := []byte(`300/200/example.com/fill/hero.jpg
+https://cdn.example.com/fill/100/100/example.com/fill/thumb.jpg
+/fill/50/50/example.com/fill/a.jpg
+640/480/https://example.com/big.jpg
+`)
+
+		targets, err := ParseWarmList(data)
+		require.NoError(t, err)
+		require.Equal(t, []WarmTarget{
+			{"300", "200", "example.com/fill/hero.jpg"},
+			{"100", "100", "example.com/fill/thumb.jpg"},
+			{"50", "50", "example.com/fill/a.jpg"},
+			{"640", "480", "example.com/big.jpg"},
+		}, targets)
+	})
+
+	t.Run("preview url with other path", func(t *testing.T) {
+		_, err := ParseWarmList([]byte("https://cdn.example.com/img/fill/100/100/example.com/a.jpg\n"))
+		require.Equal(t, http.StatusBadRequest, apperror.StatusCode(err))
+	})
+
+	t.Run("sitemap", func(t *testing.T) {
+		data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://cdn.example.com/fill/300/200/example.com/hero.jpg</loc></url>
+  <url><loc> https://cdn.example.com/fill/100/100/example.com/thumb.jpg </loc></url>
+</urlset>`)
+
+		targets, err := ParseWarmList(data)
+		require.NoError(t, err)
+		require.Equal(t, []WarmTarget{
+			{"300", "200", "example.com/hero.jpg"},
+			{"100", "100", "example.com/thumb.jpg"},
+		}, targets)
+	})
+
+	t.Run("invalid line", func(t *testing.T) {
+		_, err := ParseWarmList([]byte("300/200/example.com/hero.jpg\n300/200\n"))
+		require.Equal(t, http.StatusBadRequest, apperror.StatusCode(err))
+		require.Contains(t, err.Error(), "line 2")
+	})
+
+	t.Run("sitemap without previews", func(t *testing.T) {
+		_, err := ParseWarmList([]byte(`<urlset><url><loc>http://example.com/a/b/c</loc></url></urlset>`))
+		require.Equal(t, http.StatusBadRequest, apperror.StatusCode(err))
+	})
+}
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+
+	targets := func(n int) []WarmTarget {
+		ts := make([]WarmTarget, n)
+		for i := range ts {
+			ts[i] = WarmTarget{"100", "50", "example.com/" + strconv.Itoa(i) + ".jpg"}
+		}
+
+		return ts
+	}
+
+	t.Run("bounded concurrency", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		release := make(chan struct{})
+		ta.dl.release = release
+
+		done := make(chan WarmReport)
+		go func() {
+			done <- ta.Warm(ctx, targets(5), 2)
+		}()
+
+		require.Eventually(t, func() bool { return ta.dl.count() == 2 }, time.Second, time.Millisecond)
+
+		// Other targets wait for running ones.
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, 2, ta.dl.count())
+
+		close(release)
+
+		report := <-done
+		require.Equal(t, WarmReport{Total: 5, Succeeded: 5}, report)
+		require.Equal(t, 5, ta.dl.count())
+		require.Equal(t, 5, ta.previews.puts)
+	})
+
+	t.Run("success and failure counts", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+
+		ts := append(targets(3), WarmTarget{"x", "50", "example.com/bad.jpg"})
+
+		report := ta.Warm(ctx, ts, 4)
+		require.Equal(t, 4, report.Total)
+		require.Equal(t, 3, report.Succeeded)
+		require.Equal(t, 1, report.Failed)
+		require.Len(t, report.Failures, 1)
+		require.Equal(t, "x/50/example.com/bad.jpg", report.Failures[0].Target)
+		require.Equal(t, http.StatusBadRequest, report.Failures[0].Status)
+
+		// Cached previews are warmed again without downloads.
+		report = ta.Warm(ctx, targets(3), 4)
+		require.Equal(t, 3, report.Succeeded)
+		require.Equal(t, 3, ta.dl.count())
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		ta := newTestApp(t, time.Hour)
+		ta.dl.release = make(chan struct{})
+
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan WarmReport)
+		go func() {
+			done <- ta.Warm(ctx, targets(3), 1)
+		}()
+
+		require.Eventually(t, func() bool { return ta.dl.count() == 1 }, time.Second, time.Millisecond)
+		cancel()
+
+		// Running and pending targets fail without downloads.
+		report := <-done
+		require.Equal(t, 3, report.Failed)
+		require.Zero(t, report.Succeeded)
+		require.Equal(t, 1, ta.dl.count())
+		require.Zero(t, ta.previews.puts)
+	})
+}
@@ -0,0 +1,98 @@
+package apperror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Error kind.
+type Kind int
+
+const (
+	Internal         Kind = iota // service fault
+	BadRequest                   // invalid request parameters
+	Upstream                     // remote server client error, mirrored as is
+	UnsupportedMedia             // remote file is not a supported image
+	Unprocessable                // requested geometry is impossible
+	Timeout                      // remote server did not answer in time
+	BadGateway                   // remote server is unavailable or failed
+)
+
+// Typed error.
+type Error struct {
+	Kind   Kind
+	Status int // remote server status code, for upstream errors
+	Err    error
+}
+
+// New typed error with message.
+func New(kind Kind, msg string) *Error {
+	return &Error{Kind: kind, Err: errors.New(msg)}
+}
+
+// Wrap error with kind.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+// Wrap remote server error with its status code.
+func WrapUpstream(status int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Kind: Upstream, Status: status, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Get error kind, untyped errors are internal.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	// Request deadline exceeded while waiting for remote server.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Timeout
+	}
+
+	return Internal
+}
+
+// Get http status code for error.
+func StatusCode(err error) int {
+	switch KindOf(err) {
+	case BadRequest:
+		return http.StatusBadRequest
+	case Upstream:
+		var e *Error
+		errors.As(err, &e)
+
+		return e.Status
+	case UnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	case Unprocessable:
+		return http.StatusUnprocessableEntity
+	case Timeout:
+		return http.StatusGatewayTimeout
+	case BadGateway:
+		return http.StatusBadGateway
+	case Internal:
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,48 @@
+package apperror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"untyped", errors.New("test"), http.StatusInternalServerError},
+		{"internal", New(Internal, "test"), http.StatusInternalServerError},
+		{"bad request", New(BadRequest, "test"), http.StatusBadRequest},
+		{"upstream", WrapUpstream(http.StatusForbidden, errors.New("test")), http.StatusForbidden},
+		{"unsupported media", New(UnsupportedMedia, "test"), http.StatusUnsupportedMediaType},
+		{"unprocessable", New(Unprocessable, "test"), http.StatusUnprocessableEntity},
+		{"timeout", New(Timeout, "test"), http.StatusGatewayTimeout},
+		{"bad gateway", New(BadGateway, "test"), http.StatusBadGateway},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"wrapped", fmt.Errorf("wrapped: %w", New(BadRequest, "test")), http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.code, StatusCode(tc.err))
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	base := errors.New("test")
+
+	err := Wrap(BadGateway, base)
+	require.ErrorIs(t, err, base)
+	require.Equal(t, "test", err.Error())
+	require.Equal(t, BadGateway, KindOf(err))
+
+	require.NoError(t, Wrap(BadGateway, nil))
+	require.NoError(t, WrapUpstream(http.StatusNotFound, nil))
+}
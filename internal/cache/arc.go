@@ -0,0 +1,105 @@
+package cache
+
+// Adaptive replacement cache policy, sized in bytes. Files seen once are kept
+// in recent list, files seen again in frequent list. Ghost lists remember
+// recently evicted keys, and adapt target size of recent list.
+type arc struct {
+	size      int64    // cache size in bytes
+	target    int64    // target size of recent list
+	recent    *keyList // T1, seen once
+	frequent  *keyList // T2, seen at least twice
+	recentG   *keyList // B1, evicted from recent
+	frequentG *keyList // B2, evicted from frequent
+}
+
+func newARC(size int64) *arc {
+	return &arc{
+		size:      size,
+		recent:    newKeyList(),
+		frequent:  newKeyList(),
+		recentG:   newKeyList(),
+		frequentG: newKeyList(),
+	}
+}
+
+func (p *arc) Add(key string, size int64) {
+	switch {
+	// Replaced file.
+	case p.recent.has(key) || p.frequent.has(key):
+		p.Remove(key)
+		p.frequent.push(key, size)
+
+	// Recently evicted once seen file, grow recent list.
+	case p.recentG.has(key):
+		p.target = min(p.size, p.target+size*max(1, ratio(p.frequentG, p.recentG)))
+		p.recentG.remove(key)
+		p.frequent.push(key, size)
+
+	// Recently evicted frequent file, shrink recent list.
+	case p.frequentG.has(key):
+		p.target = max(0, p.target-size*max(1, ratio(p.recentG, p.frequentG)))
+		p.frequentG.remove(key)
+		p.frequent.push(key, size)
+
+	default:
+		p.recent.push(key, size)
+	}
+
+	p.trimGhosts()
+}
+
+func (p *arc) Access(key string) {
+	if size, ok := p.recent.remove(key); ok {
+		p.frequent.push(key, size)
+		return
+	}
+
+	p.frequent.touch(key)
+}
+
+func (p *arc) Remove(key string) {
+	p.recent.remove(key)
+	p.frequent.remove(key)
+}
+
+func (p *arc) Evict() (string, bool) {
+	var (
+		key  string
+		size int64
+		ok   bool
+	)
+
+	if p.recent.len() > 0 && (p.recent.size() > p.target || p.frequent.len() == 0) {
+		key, size, ok = p.recent.pop()
+		p.recentG.push(key, size)
+	} else {
+		key, size, ok = p.frequent.pop()
+		if ok {
+			p.frequentG.push(key, size)
+		}
+	}
+
+	p.trimGhosts()
+
+	return key, ok
+}
+
+// Keep ghost lists within cache size.
+func (p *arc) trimGhosts() {
+	for p.recentG.len() > 0 && p.recent.size()+p.recentG.size() > p.size {
+		p.recentG.pop()
+	}
+
+	for p.frequentG.len() > 0 && p.recent.size()+p.frequent.size()+p.recentG.size()+p.frequentG.size() > 2*p.size {
+		p.frequentG.pop()
+	}
+}
+
+// Get size ratio of lists, zero if divisor is empty.
+func ratio(a, b *keyList) int64 {
+	if b.size() == 0 {
+		return 0
+	}
+
+	return a.size() / b.size()
+}
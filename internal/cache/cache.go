@@ -1,121 +1,1184 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+	store "github.com/yakuninmax/imgpreviewer/internal/storage"
+)
+
+// Name of cache index file in storage.
+const manifestName = "manifest.json"
+
+// Eviction reasons.
+const (
+	evictSize      = "size"
+	evictExpired   = "expired"
+	evictPurge     = "purge"
+	evictReplace   = "replace"
+	evictCorrupted = "corrupted"
+	evictRemote    = "remote" // removed by other process sharing cache
 )
 
 var (
-	ErrNotFound    = errors.New("file not found in cache")
-	ErrFileToLarge = errors.New("file size greater than cache size")
+	ErrNotFound    = apperror.New(apperror.Internal, "file not found in cache")
+	ErrFileToLarge = apperror.New(apperror.Internal, "file size greater than cache size")
 )
 
-type storage interface {
+// Cache files storage backend. Read and Open return error wrapping os.ErrNotExist
+// for missing file, and storage.ErrCorrupted for damaged file. Context bounds
+// remote storage requests.
+type Storage interface {
 	Path() string
-	Write(name string, data []byte) error
-	Read(name string) ([]byte, error)
+	Write(ctx context.Context, name string, data []byte) error
+	WriteFrom(ctx context.Context, name string, r io.Reader) (int64, error)
+	Read(ctx context.Context, name string) ([]byte, error)
+	Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
 	Delete(name string) error
+	List() (map[string]int64, error)
 	Clean() error
 }
 
 type Cache struct {
-	mu      *sync.Mutex
-	size    int64
-	queue   *queue
-	files   map[string]*item
-	storage storage
+	mu          *sync.Mutex
+	size        int64
+	maxFiles    int // max number of files, zero means unlimited
+	queue       *queue
+	files       map[string]*item
+	storage     Storage
+	maxAge      time.Duration // max file age, zero means unlimited
+	idleTimeout time.Duration // max time since last access, zero means unlimited
+	now         func() time.Time
+	metrics     cacheMetrics
+	policy      Policy
+	memory      *memory             // optional hot files layer
+	sharedDir   string              // shared index dir, empty for private cache
+	journal     *journal            // shared index, opened by Load
+	accessed    map[string]struct{} // keys accessed since last shared index update
+	onError     func(error)         // reports errors, that are not returned to caller
+}
+
+// Cache instrumentation, labeled by cache name.
+type cacheMetrics struct {
+	name      string
+	hits      *metrics.Counter
+	misses    *metrics.Counter
+	evictions *metrics.Counter
+	bytes     *metrics.Gauge
+	capacity  *metrics.Gauge
+	maxFiles  *metrics.Gauge
+	entries   *metrics.Gauge
+	memHits   *metrics.Counter
+	memBytes  *metrics.Gauge
+}
+
+// Cache option.
+type Option func(*Cache)
+
+// Set max age of cached files.
+func WithMaxAge(d time.Duration) Option {
+	return func(c *Cache) {
+		c.maxAge = d
+	}
+}
+
+// Set max idle time of cached files.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Cache) {
+		c.idleTimeout = d
+	}
+}
+
+// Set max number of cached files, zero means unlimited.
+func WithMaxFiles(n int) Option {
+	return func(c *Cache) {
+		c.maxFiles = n
+	}
+}
+
+// Keep hot files in memory layer of given size in bytes, with its own eviction policy.
+func WithMemory(size int64, policy Policy) Option {
+	return func(c *Cache) {
+		c.memory = newMemory(size, policy)
+	}
+}
+
+// Share cache folder with other processes on the same host. Index changes are
+// exchanged through journal in given local dir, which is opened by Load.
+// File access order is tracked by each process on its own, access times are
+// shared on next index update, e.g. by janitor.
+func WithShared(dir string) Option {
+	return func(c *Cache) {
+		c.sharedDir = dir
+	}
+}
+
+// Report errors, that are not returned to caller, e.g. failed removal of
+// expired file, which is served as cache miss.
+func WithErrorHandler(fn func(error)) Option {
+	return func(c *Cache) {
+		c.onError = fn
+	}
+}
+
+// Set eviction policy, LRU is used by default.
+func WithPolicy(p Policy) Option {
+	return func(c *Cache) {
+		c.policy = p
+	}
+}
+
+// Register cache metrics with given cache name.
+func WithMetrics(reg *metrics.Registry, name string) Option {
+	return func(c *Cache) {
+		c.metrics = cacheMetrics{
+			name:      name,
+			hits:      reg.Counter("imgpreviewer_cache_hits_total", "Number of cache hits.", "cache"),
+			misses:    reg.Counter("imgpreviewer_cache_misses_total", "Number of cache misses.", "cache"),
+			evictions: reg.Counter("imgpreviewer_cache_evictions_total", "Number of evicted cache files.", "cache", "reason"),
+			bytes:     reg.Gauge("imgpreviewer_cache_bytes", "Size of cached files in bytes.", "cache"),
+			capacity:  reg.Gauge("imgpreviewer_cache_capacity_bytes", "Cache size limit in bytes.", "cache"),
+			maxFiles:  reg.Gauge("imgpreviewer_cache_capacity_entries", "Cached files limit, zero means unlimited.", "cache"),
+			entries:   reg.Gauge("imgpreviewer_cache_entries", "Number of cached files.", "cache"),
+			memHits:   reg.Counter("imgpreviewer_cache_memory_hits_total", "Number of cache hits served from memory.", "cache"),
+			memBytes:  reg.Gauge("imgpreviewer_cache_memory_bytes", "Size of files kept in memory in bytes.", "cache"),
+		}
+	}
 }
 
 type file struct {
-	url  string
-	size int64 // image size in bytes
-	name string
+	url      string
+	size     int64 // stored size in bytes, file header included
+	name     string
+	meta     Meta
+	created  time.Time
+	accessed time.Time
+}
+
+// Get index entry of file.
+func (f file) entry() manifestEntry {
+	return manifestEntry{f.url, f.name, f.size, f.created, f.accessed, f.meta}
+}
+
+// Cached file metadata.
+type Meta struct {
+	ContentType string    `json:"contentType"`
+	ETag        string    `json:"etag,omitempty"`
+	ModTime     time.Time `json:"modTime,omitempty"`
+	Expires     time.Time `json:"expires,omitempty"` // zero means always fresh
+	Origin      Origin    `json:"origin"`
+}
+
+// Remote original image version.
+type Origin struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Digest       string `json:"digest,omitempty"` // original image hash
+}
+
+// Check if file is fresh at given time.
+func (m Meta) IsFresh(now time.Time) bool {
+	return m.Expires.IsZero() || now.Before(m.Expires)
+}
+
+// Cached file description.
+type Entry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Accessed time.Time `json:"accessed"`
+	Meta
 }
 
-func New(size int64, storage storage) *Cache {
+// Cache index entry, stored in manifest.
+type manifestEntry struct {
+	Key      string    `json:"key"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Accessed time.Time `json:"accessed"`
+	Meta
+}
+
+func New(size int64, storage Storage, opts ...Option) *Cache {
 	mutex := &sync.Mutex{}
 
-	return &Cache{
-		mu:      mutex,
-		size:    size,
-		queue:   newQueue(),
-		files:   make(map[string]*item),
-		storage: storage,
+	c := &Cache{
+		mu:       mutex,
+		size:     size,
+		queue:    newQueue(),
+		files:    make(map[string]*item),
+		accessed: make(map[string]struct{}),
+		storage:  storage,
+		now:      time.Now,
+		onError:  func(error) {},
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
+
+	if c.policy == nil {
+		c.policy = newLRU()
+	}
+
+	c.metrics.capacity.Set(float64(size), c.metrics.name)
+	c.metrics.maxFiles.Set(float64(c.maxFiles), c.metrics.name)
+	c.observeSize()
+
+	return c
 }
 
-// Get file from cache.
-func (c *Cache) Get(key string) ([]byte, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Get file and its metadata from cache.
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Meta{}, err
+	}
 
-	// Check if file exists.
-	_, exists := c.files[key]
+	name, img, meta, found, err := c.lookup(key)
+	if !found || img != nil {
+		return img, meta, err
+	}
 
-	if !exists {
-		return nil, nil
+	// Read file without lock.
+	img, err = c.readFile(ctx, name)
+	switch {
+	// File was evicted or replaced while reading.
+	case errors.Is(err, os.ErrNotExist):
+		c.metrics.misses.Inc(c.metrics.name)
+		return nil, Meta{}, nil
+	// Corrupted file is removed.
+	case errors.Is(err, store.ErrCorrupted):
+		c.metrics.misses.Inc(c.metrics.name)
+		return nil, Meta{}, c.remove(key, name, evictCorrupted)
+	case err != nil:
+		return nil, Meta{}, err
+	}
+
+	c.keep(key, name, img)
+	c.metrics.hits.Inc(c.metrics.name)
+
+	return img, meta, nil
+}
+
+// Open file for streaming read, returns nil reader if file is not cached.
+// Reader must be closed. Files which fit memory layer are read and kept there,
+// larger files are streamed.
+func (c *Cache) Open(ctx context.Context, key string) (io.ReadSeekCloser, Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Meta{}, err
+	}
+
+	name, img, meta, found, err := c.lookup(key)
+	if !found {
+		return nil, meta, err
+	}
+
+	if img != nil {
+		return memoryReader{bytes.NewReader(img)}, meta, nil
+	}
+
+	// Open file without lock, opened file is readable after eviction.
+	file, err := c.openFile(ctx, name)
+	switch {
+	// File was evicted or replaced while opening.
+	case errors.Is(err, os.ErrNotExist):
+		c.metrics.misses.Inc(c.metrics.name)
+		return nil, Meta{}, nil
+	// Corrupted file is removed.
+	case errors.Is(err, store.ErrCorrupted):
+		c.metrics.misses.Inc(c.metrics.name)
+		return nil, Meta{}, c.remove(key, name, evictCorrupted)
+	case err != nil:
+		return nil, Meta{}, err
+	}
+
+	if c.memory != nil {
+		file, err = c.promote(key, name, file)
+		if err != nil {
+			return nil, Meta{}, err
+		}
+	}
+
+	c.metrics.hits.Inc(c.metrics.name)
+
+	return file, meta, nil
+}
+
+// Read opened file into memory layer, if it fits. Returns reader of file kept
+// in memory, or given file for larger one.
+func (c *Cache) promote(key, name string, file io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
 	}
 
-	// Read file.
-	img, err := c.storage.Read(c.files[key].file.name)
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
-	// Move to front.
-	c.queue.moveToFront(c.files[key])
-	c.files[key] = c.queue.getFront()
+	if size > c.memory.size {
+		return file, nil
+	}
 
-	return img, nil
+	img, err := io.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	c.keep(key, name, img)
+
+	return memoryReader{bytes.NewReader(img)}, nil
 }
 
-// Put file to cache.
-func (c *Cache) Put(key string, data []byte) error {
+// Keep file data in memory, if file is still cached.
+func (c *Cache) keep(key, name string, img []byte) {
 	c.mu.Lock()
+	if item, exists := c.files[key]; exists && item.file.name == name {
+		c.memory.put(key, img)
+		c.observeSize()
+	}
+	c.mu.Unlock()
+}
+
+// Find cached file for read, and count hit or miss. Returns file name to read,
+// or file data kept in memory. Expired file is removed.
+func (c *Cache) lookup(key string) (string, []byte, Meta, bool, error) {
+	err := c.lockRead()
+	if err != nil {
+		c.mu.Unlock()
+		return "", nil, Meta{}, false, err
+	}
+
+	// Check if file exists.
+	item, exists := c.files[key]
+
+	if !exists {
+		c.policy.Access(key)
+		c.mu.Unlock()
+
+		c.metrics.misses.Inc(c.metrics.name)
+		return "", nil, Meta{}, false, nil
+	}
+
+	// Expired file is removed, failed removal is not a reason to fail request.
+	now := c.now()
+	if c.isExpired(item.file, now) {
+		name := item.file.name
+		c.mu.Unlock()
+
+		c.metrics.misses.Inc(c.metrics.name)
+
+		err := c.remove(key, name, evictExpired)
+		if err != nil {
+			c.onError(fmt.Errorf("failed to remove expired file: %w", err))
+		}
+
+		return "", nil, Meta{}, false, nil
+	}
+
+	c.touch(item, now)
+	name, meta := item.file.name, item.file.meta
+
+	// Serve from memory.
+	if img, cached := c.memory.get(key); cached {
+		c.mu.Unlock()
+
+		c.metrics.hits.Inc(c.metrics.name)
+		c.metrics.memHits.Inc(c.metrics.name)
+		return name, img, meta, true, nil
+	}
+
+	c.mu.Unlock()
+
+	return name, nil, meta, true, nil
+}
+
+// Reader of file kept in memory.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+// Get file metadata from cache, without reading file.
+func (c *Cache) Stat(key string) (Meta, bool) {
+	// Stale index is used, if shared index is unavailable.
+	_ = c.lockRead()
 	defer c.mu.Unlock()
 
-	// Get file size.
-	size := int64(len(data))
+	// Check if file exists.
+	item, exists := c.files[key]
+	if !exists {
+		return Meta{}, false
+	}
+
+	// Expired file is treated as missing, janitor removes it.
+	now := c.now()
+	if c.isExpired(item.file, now) {
+		return Meta{}, false
+	}
+
+	c.touch(item, now)
+
+	return item.file.meta, true
+}
+
+// Update file metadata, file content is not changed.
+func (c *Cache) SetMeta(key string, meta Meta) bool {
+	if c.lockUpdate() != nil {
+		return false
+	}
+
+	item, exists := c.files[key]
+	if exists {
+		item.file.meta = meta
+		c.journal.record(opMeta, item.file.entry())
+	}
+
+	// Metadata update is best effort.
+	_ = c.unlockUpdate()
+
+	return exists
+}
+
+// Put file to cache.
+func (c *Cache) Put(ctx context.Context, key string, data []byte, meta Meta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Get file name as hash of key (url), and version. Every version is
+	// written to new file, so concurrent readers never see partial file.
+	name, err := fileName(key)
+	if err != nil {
+		return err
+	}
+
+	// New cache file, its size is stored size with header.
+	now := c.now()
+	file := file{key, 0, name, meta, now, now}
+
+	stored, err := encodeFile(file, data)
+	if err != nil {
+		return err
+	}
 
 	// Check if file size greater than cache size.
+	size := int64(len(stored))
 	if size > c.size {
 		return ErrFileToLarge
 	}
+	file.size = size
+
+	// Write file without lock.
+	err = c.storage.Write(ctx, name, stored)
+	if err != nil {
+		return err
+	}
 
-	// Get file name as hash of key (url).
-	name := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	return c.add(file, data)
+}
+
+// Put file from reader, so large file is not buffered in memory. File is not
+// added to memory layer.
+func (c *Cache) PutFrom(ctx context.Context, key string, r io.Reader, meta Meta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// New cache file.
-	file := file{key, size, name}
+	name, err := fileName(key)
+	if err != nil {
+		return err
+	}
+
+	now := c.now()
+	file := file{key, 0, name, meta, now, now}
+
+	header, err := encodeFile(file, nil)
+	if err != nil {
+		return err
+	}
+
+	// Read at most one byte over cache size, to detect too large file.
+	limited := io.LimitReader(r, c.size-int64(len(header))+1)
+
+	// Write file without lock.
+	size, err := c.storage.WriteFrom(ctx, name, io.MultiReader(bytes.NewReader(header), limited))
+	if err != nil {
+		return errors.Join(err, c.deleteFiles([]string{name}))
+	}
+
+	if size > c.size {
+		return errors.Join(ErrFileToLarge, c.deleteFiles([]string{name}))
+	}
+	file.size = size
+
+	return c.add(file, nil)
+}
+
+// Add written file to index, replacing existing file, and evict files to fit
+// it. Nil data is not added to memory layer.
+func (c *Cache) add(file file, data []byte) error {
+	err := c.lockUpdate()
+	if err != nil {
+		return errors.Join(err, c.deleteFiles([]string{file.name}))
+	}
+
+	key := file.url
+
+	// Replace existing file.
+	var unlinked []string
+	if item, exists := c.files[key]; exists {
+		unlinked = append(unlinked, c.unlink(item, evictReplace))
+	}
 
 	// Check if cache space available, and cleanup.
-	if c.queue.size+size > c.size {
-		for {
-			err := c.storage.Delete(c.queue.getBack().file.name)
+	unlinked = append(unlinked, c.evictToFit(file.size, 1)...)
+
+	// Add to queue front.
+	c.queue.pushFront(file)
+	c.files[key] = c.queue.getFront()
+	c.policy.Add(key, file.size)
+	if data != nil {
+		c.memory.put(key, data)
+	}
+	c.journal.record(opPut, file.entry())
+	c.observeSize()
+
+	err = c.unlockUpdate()
+
+	// Delete old files without lock.
+	return errors.Join(err, c.deleteFiles(unlinked))
+}
+
+// Load cache index from storage manifest. Shared cache index is restored from
+// shared index, manifest is imported only into empty shared index.
+func (c *Cache) Load() error {
+	if c.sharedDir != "" && c.journal == nil {
+		j, err := openJournal(c.sharedDir)
+		if err != nil {
+			return err
+		}
+
+		c.journal = j
+	}
+
+	err := c.lockUpdate()
+	if err != nil {
+		return err
+	}
+
+	var unlinked []string
+
+	// Manifest is imported by first process only.
+	if c.journal == nil || c.journal.created && c.journal.empty() {
+		unlinked, err = c.loadManifest()
+		if err != nil {
+			return errors.Join(err, c.unlockUpdate())
+		}
+
+		// Share imported index.
+		if c.journal != nil {
+			c.journal.stale = true
+		}
+	}
+
+	// Cleanup, if cache size or files limit shrank.
+	unlinked = append(unlinked, c.evictToFit(0, 0)...)
+
+	// Remove expired files.
+	_, expired := c.removeExpired(c.now())
+	unlinked = append(unlinked, expired...)
+
+	err = c.unlockUpdate()
+
+	return errors.Join(err, c.deleteFiles(unlinked))
+}
+
+// Restore index from manifest, and headers of files missing in it, must be
+// called with lock held. Returns stored files, that can't be restored.
+func (c *Cache) loadManifest() ([]string, error) {
+	// Read manifest, if exists.
+	var entries []manifestEntry
+
+	data, err := c.storage.Read(context.Background(), manifestName)
+	switch {
+	// Index is rebuilt from file headers without manifest.
+	case errors.Is(err, os.ErrNotExist):
+	case errors.Is(err, store.ErrCorrupted):
+		c.onError(fmt.Errorf("cache manifest is damaged, index is rebuilt from files: %w", err))
+	case err != nil:
+		return nil, err
+	default:
+		err = json.Unmarshal(data, &entries)
+		if err != nil {
+			c.onError(fmt.Errorf("cache manifest is damaged, index is rebuilt from files: %w", err))
+			entries = nil
+		}
+	}
+
+	now := c.now()
+
+	// Get stored files.
+	stored, err := c.storage.List()
+	if err != nil {
+		return nil, err
+	}
+	delete(stored, manifestName)
+
+	// Restore files, manifest is ordered from most to least recent.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+
+		size, exists := stored[e.Name]
+		if !exists || size != e.Size {
+			continue
+		}
+		delete(stored, e.Name)
+
+		// Skip duplicated keys.
+		if _, exists := c.files[e.Key]; exists {
+			continue
+		}
+
+		// Manifest without timestamps.
+		if e.Created.IsZero() {
+			e.Created, e.Accessed = now, now
+		}
+
+		c.queue.pushFront(file{e.Key, e.Size, e.Name, e.Meta, e.Created, e.Accessed})
+		c.files[e.Key] = c.queue.getFront()
+		c.policy.Add(e.Key, e.Size)
+	}
+
+	// Files written after manifest was saved are restored from their headers.
+	unlinked, err := c.restoreFiles(stored)
+	c.observeSize()
+
+	return unlinked, err
+}
+
+// Restore index entries from headers of given stored files, must be called
+// with lock held. Returns damaged files, and older file versions.
+func (c *Cache) restoreFiles(stored map[string]int64) ([]string, error) {
+	var (
+		files    []file
+		unlinked []string
+	)
+
+	for name, size := range stored {
+		h, err := c.readFileHeader(name)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		// Damaged file.
+		case errors.Is(err, store.ErrCorrupted):
+			unlinked = append(unlinked, name)
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		files = append(files, file{h.Key, size, name, h.Meta, h.Created, h.Created})
+	}
+
+	// Add files from least to most recent, newest version of key is kept.
+	slices.SortFunc(files, func(a, b file) int { return a.created.Compare(b.created) })
+
+	for _, f := range files {
+		if item, exists := c.files[f.url]; exists {
+			if !f.created.After(item.file.created) {
+				unlinked = append(unlinked, f.name)
+				continue
+			}
+
+			unlinked = append(unlinked, c.unlink(item, evictReplace))
+		}
+
+		c.queue.pushFront(f)
+		c.files[f.url] = c.queue.getFront()
+		c.policy.Add(f.url, f.size)
+	}
+
+	return unlinked, nil
+}
+
+// Read stored file header.
+func (c *Cache) readFileHeader(name string) (fileHeader, error) {
+	f, err := c.storage.Open(context.Background(), name)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer f.Close()
+
+	h, _, err := readHeader(f)
+
+	return h, err
+}
+
+// Read stored file content.
+func (c *Cache) readFile(ctx context.Context, name string) ([]byte, error) {
+	data, err := c.storage.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, data, err = decodeFile(data)
+
+	return data, err
+}
+
+// Open stored file content.
+func (c *Cache) openFile(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	f, err := c.storage.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := openContent(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// Save cache index to storage manifest. Shared cache index is compacted too.
+func (c *Cache) Save() error {
+	return c.save(true)
+}
+
+// Periodically save cache index to storage manifest, until context is done, so
+// index survives unclean exit. Shared cache index is not compacted.
+func (c *Cache) RunSaver(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.save(false)
 			if err != nil {
-				return err
+				onError(err)
 			}
+		}
+	}
+}
+
+// Save cache index to storage manifest, shared index is compacted if requested.
+func (c *Cache) save(compact bool) error {
+	err := c.lockUpdate()
+	if err != nil {
+		return err
+	}
+
+	if c.journal != nil && compact {
+		c.journal.stale = true
+	}
+
+	data, err := json.Marshal(c.snapshot())
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to create cache manifest: %w", err), c.unlockUpdate())
+	}
+
+	return errors.Join(c.storage.Write(context.Background(), manifestName, data), c.unlockUpdate())
+}
+
+// Close shared index. Private cache has nothing to close.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.journal == nil {
+		return nil
+	}
+
+	err := c.journal.close()
+	c.journal = nil
+
+	return err
+}
+
+// Remove file from cache, returns false if file does not exist.
+func (c *Cache) Delete(key string) (bool, error) {
+	err := c.lockUpdate()
+	if err != nil {
+		return false, err
+	}
+
+	item, exists := c.files[key]
+	if !exists {
+		return false, c.unlockUpdate()
+	}
+
+	name := c.unlink(item, evictPurge)
+	err = c.unlockUpdate()
+
+	return true, errors.Join(err, c.deleteFiles([]string{name}))
+}
+
+// Remove files with matching keys, returns number of removed files.
+func (c *Cache) DeleteFunc(match func(key string) bool) (int, error) {
+	err := c.lockUpdate()
+	if err != nil {
+		return 0, err
+	}
+
+	removed, unlinked := c.deleteFunc(func(f file) bool { return match(f.url) }, evictPurge)
+	err = c.unlockUpdate()
+
+	return removed, errors.Join(err, c.deleteFiles(unlinked))
+}
+
+// Remove all files from cache, returns number of removed files.
+func (c *Cache) Flush() (int, error) {
+	return c.DeleteFunc(func(string) bool { return true })
+}
+
+// List cached files from most to least recent.
+func (c *Cache) Entries() []Entry {
+	// Stale index is used, if shared index is unavailable.
+	_ = c.lockRead()
+	defer c.mu.Unlock()
+
+	entries := make([]Entry, 0, len(c.files))
+	for i := c.queue.getFront(); i != nil; i = i.next {
+		entries = append(entries, Entry{i.file.url, i.file.size, i.file.created, i.file.accessed, i.file.meta})
+	}
+
+	return entries
+}
+
+// Remove expired files from cache, returns number of removed files.
+func (c *Cache) RemoveExpired() (int, error) {
+	err := c.lockUpdate()
+	if err != nil {
+		return 0, err
+	}
+
+	removed, unlinked := c.removeExpired(c.now())
+	err = c.unlockUpdate()
+
+	return removed, errors.Join(err, c.deleteFiles(unlinked))
+}
+
+// Periodically remove expired files, until context is done.
+func (c *Cache) RunJanitor(ctx context.Context, interval time.Duration, onError func(error)) {
+	// Nothing expires.
+	if c.maxAge == 0 && c.idleTimeout == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := c.RemoveExpired()
+			if err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Remove expired files from index, must be called with lock held.
+// Returns number of removed files, and storage files to delete.
+func (c *Cache) removeExpired(now time.Time) (int, []string) {
+	// Nothing expires.
+	if c.maxAge == 0 && c.idleTimeout == 0 {
+		return 0, nil
+	}
+
+	return c.deleteFunc(func(f file) bool { return c.isExpired(f, now) }, evictExpired)
+}
+
+// Remove matching files from index from least to most recent, must be called
+// with lock held. Returns number of removed files, and storage files to delete.
+func (c *Cache) deleteFunc(match func(f file) bool, reason string) (int, []string) {
+	var unlinked []string
+
+	for i := c.queue.getBack(); i != nil; {
+		prev := i.prev
 
-			delete(c.files, c.queue.getBack().file.url)
-			c.queue.remove(c.queue.back)
+		if match(i.file) {
+			unlinked = append(unlinked, c.unlink(i, reason))
+		}
+
+		i = prev
+	}
+
+	return len(unlinked), unlinked
+}
+
+// Check if file max age or idle timeout exceeded.
+func (c *Cache) isExpired(f file, now time.Time) bool {
+	if c.maxAge > 0 && now.Sub(f.created) > c.maxAge {
+		return true
+	}
+
+	return c.idleTimeout > 0 && now.Sub(f.accessed) > c.idleTimeout
+}
+
+// Mark file as accessed, and move it to front.
+func (c *Cache) touch(item *item, now time.Time) {
+	item.file.accessed = now
+
+	// Access times are shared in batches.
+	if c.journal != nil {
+		c.accessed[item.file.url] = struct{}{}
+	}
+
+	c.queue.moveToFront(item)
+	c.files[item.file.url] = c.queue.getFront()
+	c.policy.Access(item.file.url)
+}
 
-			if c.queue.size+size <= c.size {
+// Evict files chosen by policy from index, until given number of files of
+// given total size fits. Returns storage files to delete.
+func (c *Cache) evictToFit(size int64, files int) []string {
+	var unlinked []string
+
+	for c.queue.size+size > c.size || (c.maxFiles > 0 && c.queue.count+files > c.maxFiles) {
+		key, ok := c.policy.Evict()
+		if !ok {
+			// Policy lost track of cached files, evict least recently added.
+			item := c.queue.getBack()
+			if item == nil {
 				break
 			}
+
+			unlinked = append(unlinked, c.unlink(item, evictSize))
+
+			continue
 		}
+
+		// Policy may be out of sync with index.
+		item, exists := c.files[key]
+		if !exists {
+			continue
+		}
+
+		unlinked = append(unlinked, c.unlink(item, evictSize))
+	}
+
+	return unlinked
+}
+
+// Remove file from index, returns storage file to delete.
+func (c *Cache) unlink(item *item, reason string) string {
+	delete(c.files, item.file.url)
+	c.queue.remove(item)
+	c.memory.remove(item.file.url)
+
+	// File evicted by policy is already forgotten by it.
+	if reason != evictSize {
+		c.policy.Remove(item.file.url)
 	}
 
-	// Write file.
-	err := c.storage.Write(file.name, data)
+	// Replaced file is not evicted, and file removed by other process is already shared.
+	if reason != evictReplace && reason != evictRemote {
+		c.metrics.evictions.Inc(c.metrics.name, reason)
+		c.journal.record(opDelete, item.file.entry())
+	}
+
+	c.observeSize()
+
+	return item.file.name
+}
+
+// Remove file, if it is still cached.
+func (c *Cache) remove(key, name, reason string) error {
+	err := c.lockUpdate()
 	if err != nil {
 		return err
 	}
 
-	// Add to queue front.
-	c.queue.pushFront(file)
-	c.files[key] = c.queue.getFront()
+	item, exists := c.files[key]
+	if !exists || item.file.name != name {
+		return c.unlockUpdate()
+	}
+
+	c.unlink(item, reason)
+	err = c.unlockUpdate()
+
+	return errors.Join(err, c.deleteFiles([]string{name}))
+}
+
+// Lock index for update. Shared index is locked too, and changes made by
+// other processes are applied.
+func (c *Cache) lockUpdate() error {
+	c.mu.Lock()
+
+	if c.journal == nil {
+		return nil
+	}
+
+	err := c.journal.lockFile(true)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	err = c.syncJournal(true)
+	if err != nil {
+		c.mu.Unlock()
+		return errors.Join(err, c.journal.unlockFile())
+	}
 
 	return nil
 }
+
+// Share index changes, and unlock index.
+func (c *Cache) unlockUpdate() error {
+	defer c.mu.Unlock()
+
+	if c.journal == nil {
+		return nil
+	}
+
+	// Share access times of files, that are still cached.
+	for key := range c.accessed {
+		if item, exists := c.files[key]; exists {
+			c.journal.record(opAccess, item.file.entry())
+		}
+	}
+	clear(c.accessed)
+
+	err := c.journal.flush()
+	if err == nil && c.journal.needsCompaction(len(c.files)) {
+		err = c.journal.compact(c.snapshot())
+	}
+
+	return errors.Join(err, c.journal.unlockFile())
+}
+
+// Lock index for read, and apply changes made by other processes. Index stays
+// locked on error.
+func (c *Cache) lockRead() error {
+	c.mu.Lock()
+
+	if c.journal == nil || !c.journal.changed() {
+		return nil
+	}
+
+	err := c.journal.lockFile(false)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(c.syncJournal(false), c.journal.unlockFile())
+}
+
+// Apply shared index changes, must be called with locks held.
+func (c *Cache) syncJournal(exclusive bool) error {
+	records, reset, err := c.journal.read(exclusive)
+	if err != nil {
+		return err
+	}
+
+	// Shared index is rewritten, it is restored from scratch.
+	if reset {
+		c.deleteFunc(func(file) bool { return true }, evictRemote)
+	}
+
+	for _, rec := range records {
+		item, exists := c.files[rec.Key]
+
+		switch rec.Op {
+		case opPut:
+			if exists {
+				c.unlink(item, evictReplace)
+			}
+
+			c.queue.pushFront(file{rec.Key, rec.Size, rec.Name, rec.Meta, rec.Created, rec.Accessed})
+			c.files[rec.Key] = c.queue.getFront()
+			c.policy.Add(rec.Key, rec.Size)
+
+		case opMeta:
+			if exists && item.file.name == rec.Name {
+				item.file.meta = rec.Meta
+			}
+
+		case opAccess:
+			if exists && item.file.name == rec.Name && rec.Accessed.After(item.file.accessed) {
+				item.file.accessed = rec.Accessed
+			}
+
+		case opDelete:
+			if exists && item.file.name == rec.Name {
+				c.unlink(item, evictRemote)
+			}
+		}
+	}
+
+	c.observeSize()
+
+	return nil
+}
+
+// Get index entries from most to least recent, must be called with lock held.
+func (c *Cache) snapshot() []manifestEntry {
+	entries := make([]manifestEntry, 0, len(c.files))
+	for i := c.queue.getFront(); i != nil; i = i.next {
+		entries = append(entries, i.file.entry())
+	}
+
+	return entries
+}
+
+// Delete files from storage, must be called without lock held.
+func (c *Cache) deleteFiles(names []string) error {
+	var errs []error
+
+	for _, name := range names {
+		err := c.storage.Delete(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Get new unique storage file name for key.
+func fileName(key string) (string, error) {
+	version := make([]byte, 8)
+
+	_, err := rand.Read(version)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file name: %w", err)
+	}
+
+	return fmt.Sprintf("%x-%x", sha256.Sum256([]byte(key)), version), nil
+}
+
+// Update cache size metrics.
+func (c *Cache) observeSize() {
+	c.metrics.bytes.Set(float64(c.queue.size), c.metrics.name)
+	c.metrics.entries.Set(float64(c.queue.count), c.metrics.name)
+	c.metrics.memBytes.Set(float64(c.memory.usage()), c.metrics.name)
+}
@@ -1,14 +1,26 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
 	store "github.com/yakuninmax/imgpreviewer/internal/storage"
 )
 
 func TestCache(t *testing.T) {
+	ctx := context.Background()
 	size := int64(500000)
 
 	testFiles := []file{
@@ -55,12 +67,12 @@ func TestCache(t *testing.T) {
 	}
 
 	t.Run("put files to cache", func(t *testing.T) {
-		s, _ := store.New("/tmp/test")
+		s, _ := store.New("/tmp/test", false)
 		c := New(size, s)
 		for _, file := range testFiles {
 			d, _ := os.ReadFile(file.url)
 
-			err := c.Put(file.url, d)
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
 
 			require.NoError(t, err)
 		}
@@ -69,62 +81,876 @@ func TestCache(t *testing.T) {
 	})
 
 	t.Run("get file from cache", func(t *testing.T) {
-		s, _ := store.New("/tmp/test")
+		s, _ := store.New("/tmp/test", false)
 		c := New(size, s)
 
 		d, _ := os.ReadFile(testFiles[0].url)
-		err := c.Put(testFiles[0].url, d)
+		err := c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"})
 		require.NoError(t, err)
 
-		cd, err := c.Get(testFiles[0].url)
+		cd, meta, err := c.Get(ctx, testFiles[0].url)
 		require.NoError(t, err)
 		require.Equal(t, d, cd)
+		require.Equal(t, "image/jpeg", meta.ContentType)
+
+		_ = s.Clean()
+	})
+
+	t.Run("get file metadata", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		_, exists := c.Stat(testFiles[0].url)
+		require.False(t, exists)
+
+		meta := Meta{ContentType: "image/jpeg", ETag: `"test"`, ModTime: time.Unix(1000, 0)}
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		err := c.Put(ctx, testFiles[0].url, d, meta)
+		require.NoError(t, err)
+
+		cm, exists := c.Stat(testFiles[0].url)
+		require.True(t, exists)
+		require.Equal(t, meta, cm)
+
+		_ = s.Clean()
+	})
+
+	t.Run("update file metadata", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		require.False(t, c.SetMeta(testFiles[0].url, Meta{}))
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		err := c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"})
+		require.NoError(t, err)
+
+		meta := Meta{ContentType: "image/jpeg", Expires: time.Now().Add(time.Hour)}
+		require.True(t, c.SetMeta(testFiles[0].url, meta))
+
+		cd, cm, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+		require.Equal(t, meta, cm)
+		require.True(t, cm.IsFresh(time.Now()))
+		require.False(t, cm.IsFresh(time.Now().Add(2*time.Hour)))
+
+		_ = s.Clean()
+	})
+
+	t.Run("put existing file", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		for i := 0; i < 3; i++ {
+			err := c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		require.Len(t, c.files, 1)
+		require.Equal(t, getFileSize(s, c.files[testFiles[0].url].file.name), c.queue.size)
+		require.Equal(t, c.queue.getFront(), c.queue.getBack())
+		require.Equal(t, c.queue.size, getDirSize(s))
 
 		_ = s.Clean()
 	})
 
 	t.Run("put file larger than cache size", func(t *testing.T) {
 		size := int64(1000)
-		s, _ := store.New("/tmp/test")
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		err := c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"})
+
+		require.ErrorIs(t, err, ErrFileToLarge)
+
+		_ = s.Clean()
+	})
+
+	t.Run("put file from reader", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		err := c.PutFrom(ctx, testFiles[0].url, bytes.NewReader(d), Meta{ContentType: "image/jpeg"})
+		require.NoError(t, err)
+
+		cd, meta, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+		require.Equal(t, "image/jpeg", meta.ContentType)
+		require.Equal(t, c.queue.size, getDirSize(s))
+
+		_ = s.Clean()
+	})
+
+	t.Run("put file larger than cache size from reader", func(t *testing.T) {
+		size := int64(1000)
+		s, _ := store.New("/tmp/test", false)
 		c := New(size, s)
 
 		d, _ := os.ReadFile(testFiles[0].url)
-		err := c.Put(testFiles[0].url, d)
+		err := c.PutFrom(ctx, testFiles[0].url, bytes.NewReader(d), Meta{ContentType: "image/jpeg"})
 
 		require.ErrorIs(t, err, ErrFileToLarge)
+		require.Empty(t, c.files)
+		require.Zero(t, getDirSize(s))
 
 		_ = s.Clean()
 	})
 
 	t.Run("cache oversize", func(t *testing.T) {
-		s, _ := store.New("/tmp/test")
+		s, _ := store.New("/tmp/test", false)
 		c := New(int64(300000), s)
 
 		t.Log(s.Path())
 		for _, file := range testFiles {
 			d, _ := os.ReadFile(file.url)
 
-			err := c.Put(file.url, d)
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
 
 			require.NoError(t, err)
 		}
 
-		ds := getDirSize(s.Path())
+		ds := getDirSize(s)
 
 		require.LessOrEqual(t, ds, c.size)
 
 		_ = s.Clean()
 	})
+
+	t.Run("max files", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s, WithMaxFiles(3))
+
+		for _, file := range testFiles[:5] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		require.Len(t, c.files, 3)
+		require.Equal(t, 3, c.queue.count)
+		require.NotContains(t, c.files, testFiles[0].url)
+		require.NotContains(t, c.files, testFiles[1].url)
+		require.Equal(t, getDirSize(s), c.queue.size)
+
+		_ = s.Clean()
+	})
+
+	t.Run("evict without policy entries", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s, WithMaxFiles(3), WithPolicy(forgetfulPolicy{}))
+
+		for _, file := range testFiles[:5] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		// Oldest files are evicted.
+		require.Len(t, c.files, 3)
+		require.NotContains(t, c.files, testFiles[0].url)
+		require.NotContains(t, c.files, testFiles[1].url)
+		require.Equal(t, getDirSize(s), c.queue.size)
+
+		_ = s.Clean()
+	})
+
+	t.Run("memory layer", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s, WithMemory(testFiles[0].size+testFiles[1].size, newLRU()))
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		// Written through, first file is evicted from memory.
+		require.Len(t, c.memory.files, 2)
+		require.Equal(t, testFiles[1].size+testFiles[2].size, c.memory.usage())
+
+		// Hit is served from memory, without storage read.
+		name := c.files[testFiles[1].url].file.name
+		require.NoError(t, s.Delete(name))
+
+		d, _ := os.ReadFile(testFiles[1].url)
+		cd, _, err := c.Get(ctx, testFiles[1].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+
+		// Storage hit is promoted to memory.
+		_, _, err = c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Contains(t, c.memory.files, testFiles[0].url)
+		require.LessOrEqual(t, c.memory.usage(), c.memory.size)
+
+		// Removed file is removed from memory.
+		_, err = c.Delete(testFiles[0].url)
+		require.NoError(t, err)
+		require.NotContains(t, c.memory.files, testFiles[0].url)
+
+		_ = s.Clean()
+	})
+
+	t.Run("open promotes to memory layer", func(t *testing.T) {
+		s, _ := store.New(t.TempDir(), false)
+		c := New(size, s, WithMemory(100, newLRU()))
+
+		data := bytes.Repeat([]byte("a"), 60)
+		for _, key := range []string{"a", "b"} {
+			require.NoError(t, c.Put(ctx, key, data, Meta{}))
+		}
+		require.NotContains(t, c.memory.files, "a")
+
+		// Storage hit is promoted to memory, and is served from there.
+		f, _, err := c.Open(ctx, "a")
+		require.NoError(t, err)
+		require.IsType(t, memoryReader{}, f)
+		cd, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, data, cd)
+		require.NoError(t, f.Close())
+		require.Contains(t, c.memory.files, "a")
+		require.NotContains(t, c.memory.files, "b")
+
+		// File larger than memory layer is streamed.
+		large := bytes.Repeat([]byte("c"), 200)
+		require.NoError(t, c.Put(ctx, "c", large, Meta{}))
+
+		f, _, err = c.Open(ctx, "c")
+		require.NoError(t, err)
+		require.IsType(t, &contentReader{}, f)
+		cd, err = io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, large, cd)
+		require.NoError(t, f.Close())
+		require.NotContains(t, c.memory.files, "c")
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s, WithMaxAge(time.Minute))
+
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		err := c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"})
+		require.NoError(t, err)
+
+		// Access does not extend max age.
+		now = now.Add(50 * time.Second)
+		cd, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+
+		now = now.Add(20 * time.Second)
+		_, exists := c.Stat(testFiles[0].url)
+		require.False(t, exists)
+
+		cd, _, err = c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, cd)
+		require.Empty(t, c.files)
+		require.Equal(t, int64(0), getDirSize(s))
+
+		_ = s.Clean()
+	})
+
+	t.Run("expired file removal failure", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+
+		var reported error
+		c := New(size, failingDelete{s}, WithMaxAge(time.Minute), WithErrorHandler(func(err error) {
+			reported = err
+		}))
+
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+
+		// Expired file is a miss, even if it can't be deleted.
+		now = now.Add(2 * time.Minute)
+		cd, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, cd)
+		require.ErrorIs(t, reported, errDelete)
+		require.Empty(t, c.files)
+
+		_ = s.Clean()
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s, WithIdleTimeout(time.Minute))
+
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		// Access extends idle timeout.
+		now = now.Add(50 * time.Second)
+		_, exists := c.Stat(testFiles[1].url)
+		require.True(t, exists)
+
+		now = now.Add(20 * time.Second)
+		removed, err := c.RemoveExpired()
+		require.NoError(t, err)
+		require.Equal(t, 2, removed)
+		require.Len(t, c.files, 1)
+		require.Contains(t, c.files, testFiles[1].url)
+		require.Equal(t, getDirSize(s), c.queue.size)
+
+		_ = s.Clean()
+	})
+
+	t.Run("janitor", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s, WithMaxAge(50*time.Millisecond))
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		err := c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"})
+		require.NoError(t, err)
+
+		jctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go c.RunJanitor(jctx, 10*time.Millisecond, func(err error) {
+			require.NoError(t, err)
+		})
+
+		require.Eventually(t, func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			return len(c.files) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		_ = s.Clean()
+	})
+
+	t.Run("delete files", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		for _, file := range testFiles[:4] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		deleted, err := c.Delete(testFiles[0].url)
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		deleted, err = c.Delete(testFiles[0].url)
+		require.NoError(t, err)
+		require.False(t, deleted)
+
+		removed, err := c.DeleteFunc(func(key string) bool { return key == testFiles[1].url })
+		require.NoError(t, err)
+		require.Equal(t, 1, removed)
+
+		entries := c.Entries()
+		require.Len(t, entries, 2)
+		require.Equal(t, testFiles[3].url, entries[0].Key)
+		require.Equal(t, getFileSize(s, c.files[testFiles[3].url].file.name), entries[0].Size)
+		require.Equal(t, testFiles[2].url, entries[1].Key)
+
+		removed, err = c.Flush()
+		require.NoError(t, err)
+		require.Equal(t, 2, removed)
+		require.Empty(t, c.Entries())
+		require.Equal(t, int64(0), c.queue.size)
+		require.Equal(t, int64(0), getDirSize(s))
+
+		_ = s.Clean()
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		reg := metrics.NewRegistry()
+		c := New(testFiles[0].size+testFiles[1].size, s, WithMetrics(reg, "previews"))
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		_, _, err := c.Get(ctx, testFiles[2].url)
+		require.NoError(t, err)
+
+		_, _, err = c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+
+		out := &strings.Builder{}
+		_, err = reg.WriteTo(out)
+		require.NoError(t, err)
+		require.Contains(t, out.String(), `imgpreviewer_cache_hits_total{cache="previews"} 1`+"\n")
+		require.Contains(t, out.String(), `imgpreviewer_cache_misses_total{cache="previews"} 1`+"\n")
+		require.Contains(t, out.String(), `imgpreviewer_cache_evictions_total{cache="previews",reason="size"} 1`+"\n")
+		require.Contains(t, out.String(), `imgpreviewer_cache_entries{cache="previews"} 2`+"\n")
+		require.Contains(t, out.String(),
+			`imgpreviewer_cache_bytes{cache="previews"} `+strconv.FormatInt(getDirSize(s), 10)+"\n")
+		require.Contains(t, out.String(),
+			`imgpreviewer_cache_capacity_bytes{cache="previews"} `+strconv.FormatInt(c.size, 10)+"\n")
+
+		_ = s.Clean()
+	})
+
+	t.Run("file evicted while reading", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+
+		// File is gone from storage after index lookup.
+		require.NoError(t, s.Delete(c.files[testFiles[0].url].file.name))
+
+		cd, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, cd)
+
+		_ = s.Clean()
+	})
+
+	t.Run("corrupted file", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+
+		// Damage stored file data.
+		file := filepath.Join(s.Path(), c.files[testFiles[0].url].file.name)
+		stored, _ := os.ReadFile(file)
+		stored[len(stored)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(file, stored, 0o600))
+
+		cd, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, cd)
+		require.NotContains(t, c.files, testFiles[0].url)
+		require.Empty(t, getDirSize(s))
+
+		_ = s.Clean()
+	})
+
+	t.Run("open file", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+
+		f, meta, err := c.Open(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Equal(t, "image/jpeg", meta.ContentType)
+
+		// Opened file is readable after eviction.
+		_, err = c.Delete(testFiles[0].url)
+		require.NoError(t, err)
+
+		cd, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+		require.NoError(t, f.Close())
+
+		f, _, err = c.Open(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, f)
+
+		_ = s.Clean()
+	})
+
+	t.Run("open corrupted file", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[1].url)
+		require.NoError(t, c.Put(ctx, testFiles[1].url, d, Meta{}))
+
+		// Damage stored file data.
+		file := filepath.Join(s.Path(), c.files[testFiles[1].url].file.name)
+		stored, _ := os.ReadFile(file)
+		stored[len(stored)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(file, stored, 0o600))
+
+		// Corrupted file is a miss, and it is removed.
+		f, _, err := c.Open(ctx, testFiles[1].url)
+		require.NoError(t, err)
+		require.Nil(t, f)
+		require.NotContains(t, c.files, testFiles[1].url)
+		require.Empty(t, getDirSize(s))
+
+		_ = s.Clean()
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		s, _ := store.New("/tmp/test", false)
+		c := New(testFiles[0].size+testFiles[1].size, s, WithMemory(testFiles[1].size, newLRU()))
+
+		data := make([][]byte, 3)
+		for i, file := range testFiles[:3] {
+			data[i], _ = os.ReadFile(file.url)
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 50; j++ {
+					n := (i + j) % len(data)
+					key := testFiles[n].url
+
+					switch j % 4 {
+					case 0:
+						require.NoError(t, c.Put(ctx, key, data[n], Meta{}))
+					case 3:
+						_, err := c.Delete(key)
+						require.NoError(t, err)
+					default:
+						// Read file is either complete or missing.
+						cd, _, err := c.Get(ctx, key)
+						require.NoError(t, err)
+						if cd != nil {
+							require.Equal(t, data[n], cd)
+						}
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Storage matches index.
+		var total int64
+		for _, e := range c.Entries() {
+			total += e.Size
+		}
+		require.LessOrEqual(t, total, c.size)
+		require.Equal(t, total, getDirSize(s))
+
+		_ = s.Clean()
+	})
+
+	t.Run("restore cache from manifest", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		// Make first file most recent.
+		_, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Save())
+
+		// Restore with the same size.
+		s, _ = store.New(path, true)
+		c = New(size, s)
+		require.NoError(t, c.Load())
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		cd, meta, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+		require.Equal(t, "image/jpeg", meta.ContentType)
+		require.Equal(t, testFiles[1].url, c.queue.getBack().file.url)
+	})
+
+	t.Run("rebuild index from files without manifest", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			now = now.Add(time.Second)
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg", ETag: file.name})
+			require.NoError(t, err)
+		}
+
+		// Process is killed, manifest is not saved.
+		c = New(size, s)
+		require.NoError(t, c.Load())
+
+		require.Len(t, c.files, 3)
+		require.Equal(t, testFiles[2].url, c.queue.getFront().file.url)
+		require.Equal(t, testFiles[0].url, c.queue.getBack().file.url)
+		require.Equal(t, getDirSize(s), c.queue.size)
+
+		d, _ := os.ReadFile(testFiles[1].url)
+		cd, meta, err := c.Get(ctx, testFiles[1].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+		require.Equal(t, testFiles[1].name, meta.ETag)
+	})
+
+	t.Run("restore files written after manifest", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		for _, file := range testFiles[:2] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, c.Save())
+
+		// Add file, and replace file listed in manifest.
+		d, _ := os.ReadFile(testFiles[2].url)
+		require.NoError(t, c.Put(ctx, testFiles[2].url, d, Meta{ContentType: "image/jpeg"}))
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/png"}))
+
+		c = New(size, s)
+		require.NoError(t, c.Load())
+
+		require.Len(t, c.files, 3)
+		cd, meta, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Equal(t, d, cd)
+		require.Equal(t, "image/png", meta.ContentType)
+		require.Equal(t, getDirSize(s)-getFileSize(s, manifestName), c.queue.size)
+	})
+
+	t.Run("damaged manifest", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+		require.NoError(t, c.Save())
+
+		// Truncated manifest.
+		manifest, err := s.Read(ctx, manifestName)
+		require.NoError(t, err)
+		require.NoError(t, s.Write(ctx, manifestName, manifest[:len(manifest)/2]))
+
+		var reported error
+		c = New(size, s, WithErrorHandler(func(err error) { reported = err }))
+		require.NoError(t, c.Load())
+		require.Error(t, reported)
+		require.Contains(t, c.files, testFiles[0].url)
+	})
+
+	t.Run("files without cache header", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+
+		// Files written without header, one of them is listed in manifest.
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, s.Write(ctx, "listed", d))
+		require.NoError(t, s.Write(ctx, "unlisted", d))
+
+		manifest, _ := json.Marshal([]manifestEntry{{
+			Key:  testFiles[0].url,
+			Name: "listed",
+			Size: int64(len(d)),
+			Meta: Meta{ContentType: "image/jpeg"},
+		}})
+		require.NoError(t, s.Write(ctx, manifestName, manifest))
+
+		c := New(size, s)
+		require.NoError(t, c.Load())
+
+		// Unlisted file can't be restored, listed one is a miss and is removed.
+		require.Zero(t, getFileSize(s, "unlisted"))
+
+		cd, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, cd)
+		require.NotContains(t, c.files, testFiles[0].url)
+		require.Zero(t, getFileSize(s, "listed"))
+	})
+
+	t.Run("open file without cache header", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+
+		// Overwrite file without header.
+		require.NoError(t, s.Write(ctx, c.files[testFiles[0].url].file.name, d))
+
+		f, _, err := c.Open(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, f)
+		require.NotContains(t, c.files, testFiles[0].url)
+		require.Empty(t, getDirSize(s))
+	})
+
+	t.Run("files without storage header", func(t *testing.T) {
+		path := t.TempDir()
+
+		// Manifest and file written without storage header.
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, os.WriteFile(filepath.Join(path, "listed"), d, 0o600))
+
+		manifest, _ := json.Marshal([]manifestEntry{{
+			Key:  testFiles[0].url,
+			Name: "listed",
+			Size: int64(len(d)),
+			Meta: Meta{ContentType: "image/jpeg"},
+		}})
+		require.NoError(t, os.WriteFile(filepath.Join(path, manifestName), manifest, 0o600))
+
+		s, _ := store.New(path, true)
+
+		var reported error
+		c := New(size, s, WithErrorHandler(func(err error) { reported = err }))
+		require.NoError(t, c.Load())
+		require.ErrorIs(t, reported, store.ErrCorrupted)
+
+		// Damaged file is removed, and it is a miss.
+		cd, _, err := c.Get(ctx, testFiles[0].url)
+		require.NoError(t, err)
+		require.Nil(t, cd)
+		require.NoFileExists(t, filepath.Join(path, "listed"))
+	})
+
+	t.Run("saver", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		d, _ := os.ReadFile(testFiles[0].url)
+		require.NoError(t, c.Put(ctx, testFiles[0].url, d, Meta{ContentType: "image/jpeg"}))
+
+		sctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			c.RunSaver(sctx, 10*time.Millisecond, func(err error) {
+				require.NoError(t, err)
+			})
+		}()
+
+		require.Eventually(t, func() bool {
+			return getFileSize(s, manifestName) > 0
+		}, time.Second, 10*time.Millisecond)
+
+		// Saver is stopped before storage folder is removed.
+		cancel()
+		<-done
+	})
+
+	t.Run("evict on load if size shrank", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, c.Save())
+
+		c = New(c.files[testFiles[1].url].file.size+c.files[testFiles[2].url].file.size, s)
+		require.NoError(t, c.Load())
+
+		require.Len(t, c.files, 2)
+		require.NotContains(t, c.files, testFiles[0].url)
+		require.LessOrEqual(t, getDirSize(s)-getFileSize(s, manifestName), c.size)
+	})
+
+	t.Run("evict on load if files limit shrank", func(t *testing.T) {
+		path := t.TempDir()
+		s, _ := store.New(path, true)
+		c := New(size, s)
+
+		for _, file := range testFiles[:3] {
+			d, _ := os.ReadFile(file.url)
+
+			err := c.Put(ctx, file.url, d, Meta{ContentType: "image/jpeg"})
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, c.Save())
+
+		c = New(size, s, WithMaxFiles(1))
+		require.NoError(t, c.Load())
+
+		require.Len(t, c.files, 1)
+		require.Contains(t, c.files, testFiles[2].url)
+	})
+}
+
+// Get stored file data size.
+func getFileSize(s Storage, name string) int64 {
+	files, _ := s.List()
+
+	return files[name]
 }
 
-func getDirSize(path string) int64 {
-	dir, _ := os.Open(path)
-	defer dir.Close()
-	files, _ := dir.Readdir(0)
+// Get total stored files data size.
+func getDirSize(s Storage) int64 {
+	files, _ := s.List()
 	size := int64(0)
-	for _, file := range files {
-		size += file.Size()
+	for _, fileSize := range files {
+		size += fileSize
 	}
 
 	return size
 }
+
+// Policy, that tracks no files.
+type forgetfulPolicy struct{}
+
+func (forgetfulPolicy) Add(string, int64)     {}
+func (forgetfulPolicy) Access(string)         {}
+func (forgetfulPolicy) Remove(string)         {}
+func (forgetfulPolicy) Evict() (string, bool) { return "", false }
+
+var errDelete = errors.New("delete failed")
+
+// Storage, that fails to delete files.
+type failingDelete struct {
+	*store.Storage
+}
+
+func (failingDelete) Delete(string) error {
+	return errDelete
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	store "github.com/yakuninmax/imgpreviewer/internal/storage"
+)
+
+// Cached file header prefix is magic and header length.
+const filePrefixSize = 8
+
+// Max header length, longer header is treated as damaged.
+const maxHeaderSize = 64 << 10
+
+var fileMagic = []byte("impc")
+
+// Cached file header. It keeps file index entry as of file write, so index
+// can be rebuilt from stored files, when manifest is missing or stale.
+type fileHeader struct {
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	Meta
+}
+
+// Get stored file data, which is header followed by file content.
+func encodeFile(f file, data []byte) ([]byte, error) {
+	header, err := json.Marshal(fileHeader{f.url, f.created, f.meta})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file header: %w", err)
+	}
+
+	buf := make([]byte, 0, filePrefixSize+len(header)+len(data))
+	buf = append(buf, fileMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+
+	return append(buf, data...), nil
+}
+
+// Split stored file data into header and content.
+func decodeFile(data []byte) (fileHeader, []byte, error) {
+	h, n, err := readHeader(bytes.NewReader(data))
+	if err != nil {
+		return h, nil, err
+	}
+
+	return h, data[n:], nil
+}
+
+// Read file header, returns header and its total length. Returns
+// storage.ErrCorrupted for missing or damaged header.
+func readHeader(r io.Reader) (fileHeader, int64, error) {
+	var h fileHeader
+
+	prefix := make([]byte, filePrefixSize)
+
+	_, err := io.ReadFull(r, prefix)
+	switch {
+	// File is shorter than header.
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return h, 0, fmt.Errorf("failed to read file header: %w", store.ErrCorrupted)
+	case err != nil:
+		return h, 0, err
+	case !bytes.Equal(prefix[:len(fileMagic)], fileMagic):
+		return h, 0, fmt.Errorf("failed to read file header: %w", store.ErrCorrupted)
+	}
+
+	size := binary.BigEndian.Uint32(prefix[len(fileMagic):])
+	if size > maxHeaderSize {
+		return h, 0, fmt.Errorf("failed to read file header: %w", store.ErrCorrupted)
+	}
+
+	header := make([]byte, size)
+
+	_, err = io.ReadFull(r, header)
+	if err != nil || json.Unmarshal(header, &h) != nil {
+		return h, 0, fmt.Errorf("failed to read file header: %w", store.ErrCorrupted)
+	}
+
+	return h, filePrefixSize + int64(size), nil
+}
+
+// Stored file content reader, which skips file header.
+type contentReader struct {
+	io.ReadSeekCloser
+	offset int64 // header length
+}
+
+// Open stored file content.
+func openContent(f io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	_, n, err := readHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contentReader{f, n}, nil
+}
+
+// Seek to content offset.
+func (r *contentReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += r.offset
+	}
+
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+
+	return pos - r.offset, err
+}
@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Shared index files names.
+const (
+	journalName = "index.log"
+	lockName    = "index.lock"
+)
+
+// Journal is compacted, when it has this many times more records than cached files.
+const (
+	journalCompactRatio = 4
+	journalMinRecords   = 1024
+)
+
+// Journal record ops.
+const (
+	opPut    = "put"
+	opMeta   = "meta"
+	opAccess = "access"
+	opDelete = "delete"
+)
+
+var ErrSharedUnsupported = errors.New("shared cache is not supported on this platform")
+
+// Journal record, single JSON line.
+type journalRecord struct {
+	Op string `json:"op"`
+	manifestEntry
+}
+
+// Shared index journal. Processes sharing cache folder append index changes
+// to journal under exclusive file lock, and apply changes of each other.
+type journal struct {
+	dir     string
+	lock    *os.File
+	file    *os.File // replaced on compaction
+	offset  int64    // size of applied journal part
+	records int      // number of records in journal
+	pending [][]byte // records to append
+	stale   bool     // journal must be rewritten from index
+	created bool     // journal did not exist before open
+}
+
+func openJournal(dir string) (*journal, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shared index dir: %w", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared index lock: %w", err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, journalName))
+	j := &journal{dir: dir, lock: lock, created: errors.Is(err, os.ErrNotExist)}
+
+	err = j.open()
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Lock journal, shared lock allows concurrent readers.
+func (j *journal) lockFile(exclusive bool) error {
+	how := lockShared
+	if exclusive {
+		how = lockExclusive
+	}
+
+	err := flock(j.lock, how)
+	if err != nil {
+		return fmt.Errorf("failed to lock shared index: %w", err)
+	}
+
+	return nil
+}
+
+func (j *journal) unlockFile() error {
+	err := funlock(j.lock)
+	if err != nil {
+		return fmt.Errorf("failed to unlock shared index: %w", err)
+	}
+
+	return nil
+}
+
+// Check if journal was changed by other process, without lock.
+func (j *journal) changed() bool {
+	stat, err := os.Stat(j.path())
+	if err != nil {
+		return true
+	}
+
+	fstat, err := j.file.Stat()
+
+	return err != nil || !os.SameFile(stat, fstat) || stat.Size() != j.offset
+}
+
+// Read records appended by other processes, must be called with lock held.
+// Returns true, if journal was rewritten and index must be restored from scratch.
+// Partial record of crashed writer is dropped under exclusive lock.
+func (j *journal) read(exclusive bool) ([]journalRecord, bool, error) {
+	reset := false
+
+	stat, err := os.Stat(j.path())
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read shared index: %w", err)
+	}
+
+	fstat, err := j.file.Stat()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read shared index: %w", err)
+	}
+
+	// Journal is compacted by other process.
+	if !os.SameFile(stat, fstat) {
+		_ = j.file.Close()
+
+		err = j.open()
+		if err != nil {
+			return nil, false, err
+		}
+
+		reset = true
+	}
+
+	if stat.Size() <= j.offset {
+		return nil, reset, nil
+	}
+
+	buf := make([]byte, stat.Size()-j.offset)
+
+	_, err = j.file.ReadAt(buf, j.offset)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read shared index: %w", err)
+	}
+
+	// Complete records end with new line.
+	complete := buf[:bytes.LastIndexByte(buf, '\n')+1]
+
+	var records []journalRecord
+	for _, line := range bytes.Split(complete, []byte{'\n'}) {
+		var rec journalRecord
+
+		// Damaged records are skipped.
+		if len(line) == 0 || json.Unmarshal(line, &rec) != nil {
+			continue
+		}
+
+		records = append(records, rec)
+	}
+
+	j.offset += int64(len(complete))
+	j.records += len(records)
+
+	if exclusive && len(complete) < len(buf) {
+		err = j.file.Truncate(j.offset)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to repair shared index: %w", err)
+		}
+	}
+
+	return records, reset, nil
+}
+
+// Add record to append on flush. Nil journal records nothing.
+func (j *journal) record(op string, e manifestEntry) {
+	if j == nil {
+		return
+	}
+
+	line, err := json.Marshal(journalRecord{op, e})
+	if err != nil {
+		// Index entries are always serializable, journal is rewritten just in case.
+		j.stale = true
+		return
+	}
+
+	j.pending = append(j.pending, append(line, '\n'))
+}
+
+// Append pending records, must be called with exclusive lock held.
+func (j *journal) flush() error {
+	if len(j.pending) == 0 {
+		return nil
+	}
+
+	n, err := j.file.Write(bytes.Join(j.pending, nil))
+	j.offset += int64(n)
+	j.records += len(j.pending)
+	j.pending = nil
+
+	if err != nil {
+		return fmt.Errorf("failed to write shared index: %w", err)
+	}
+
+	return nil
+}
+
+// Check if journal must be rewritten.
+func (j *journal) needsCompaction(files int) bool {
+	return j.stale || j.records > max(journalMinRecords, files*journalCompactRatio)
+}
+
+// Replace journal with index snapshot, must be called with exclusive lock held.
+func (j *journal) compact(snapshot []manifestEntry) error {
+	var buf bytes.Buffer
+
+	for _, e := range snapshot {
+		line, err := json.Marshal(journalRecord{opPut, e})
+		if err != nil {
+			return fmt.Errorf("failed to compact shared index: %w", err)
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	temp, err := os.CreateTemp(j.dir, journalName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to compact shared index: %w", err)
+	}
+
+	// Remove temp file, if not renamed.
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(buf.Bytes())
+	if err == nil {
+		err = temp.Sync()
+	}
+
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(temp.Name(), j.path())
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to compact shared index: %w", err)
+	}
+
+	_ = j.file.Close()
+
+	err = j.open()
+	if err != nil {
+		return err
+	}
+
+	j.offset = int64(buf.Len())
+	j.records = len(snapshot)
+	j.stale = false
+
+	return nil
+}
+
+// Check if journal has no records.
+func (j *journal) empty() bool {
+	return j.offset == 0
+}
+
+func (j *journal) close() error {
+	return errors.Join(j.file.Close(), j.lock.Close())
+}
+
+// Open journal file, it is read from start.
+func (j *journal) open() error {
+	file, err := os.OpenFile(j.path(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open shared index: %w", err)
+	}
+
+	j.file = file
+	j.offset = 0
+	j.records = 0
+
+	return nil
+}
+
+func (j *journal) path() string {
+	return filepath.Join(j.dir, journalName)
+}
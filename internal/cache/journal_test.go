@@ -0,0 +1,192 @@
+//go:build unix
+
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	store "github.com/yakuninmax/imgpreviewer/internal/storage"
+)
+
+func TestSharedCache(t *testing.T) {
+	ctx := context.Background()
+
+	small, _ := os.ReadFile("../../examples/gopher_50x50.jpg")
+	large, _ := os.ReadFile("../../examples/gopher_256x126.jpg")
+
+	// Create two caches sharing storage folder and index.
+	newShared := func(t *testing.T, size int64, opts ...Option) (*Cache, *Cache, Storage) {
+		t.Helper()
+
+		path, index := t.TempDir(), t.TempDir()
+
+		s1, err := store.New(path, true)
+		require.NoError(t, err)
+		s2, err := store.New(path, true)
+		require.NoError(t, err)
+
+		c1 := New(size, s1, append(opts, WithShared(index))...)
+		require.NoError(t, c1.Load())
+		t.Cleanup(func() { _ = c1.Close() })
+
+		c2 := New(size, s2, append(opts, WithShared(index))...)
+		require.NoError(t, c2.Load())
+		t.Cleanup(func() { _ = c2.Close() })
+
+		return c1, c2, s1
+	}
+
+	t.Run("put is visible to other process", func(t *testing.T) {
+		c1, c2, _ := newShared(t, 100000)
+
+		require.NoError(t, c1.Put(ctx, "small", small, Meta{ContentType: "image/jpeg"}))
+
+		data, meta, err := c2.Get(ctx, "small")
+		require.NoError(t, err)
+		require.Equal(t, small, data)
+		require.Equal(t, "image/jpeg", meta.ContentType)
+
+		require.True(t, c2.SetMeta("small", Meta{ContentType: "image/png"}))
+
+		meta, found := c1.Stat("small")
+		require.True(t, found)
+		require.Equal(t, "image/png", meta.ContentType)
+	})
+
+	t.Run("delete is visible to other process", func(t *testing.T) {
+		c1, c2, s := newShared(t, 100000)
+
+		require.NoError(t, c1.Put(ctx, "small", small, Meta{}))
+		_, found := c2.Stat("small")
+		require.True(t, found)
+
+		removed, err := c2.Delete("small")
+		require.NoError(t, err)
+		require.True(t, removed)
+
+		data, _, err := c1.Get(ctx, "small")
+		require.NoError(t, err)
+		require.Nil(t, data)
+		require.Zero(t, getDirSize(s))
+	})
+
+	t.Run("access is shared", func(t *testing.T) {
+		c1, c2, s := newShared(t, 100000, WithIdleTimeout(time.Minute))
+
+		now := time.Now()
+		c1.now = func() time.Time { return now }
+		c2.now = func() time.Time { return now }
+
+		require.NoError(t, c1.Put(ctx, "small", small, Meta{}))
+
+		// File is accessed by second process only, its janitor shares access.
+		now = now.Add(50 * time.Second)
+		_, found := c2.Stat("small")
+		require.True(t, found)
+		_, err := c2.RemoveExpired()
+		require.NoError(t, err)
+
+		// File is idle for first process, but not for second one.
+		now = now.Add(20 * time.Second)
+		removed, err := c1.RemoveExpired()
+		require.NoError(t, err)
+		require.Zero(t, removed)
+		require.NotZero(t, getDirSize(s))
+
+		now = now.Add(time.Minute)
+		removed, err = c1.RemoveExpired()
+		require.NoError(t, err)
+		require.Equal(t, 1, removed)
+		require.Zero(t, getDirSize(s))
+	})
+
+	t.Run("eviction is coordinated", func(t *testing.T) {
+		c1, c2, s := newShared(t, int64(len(small)+len(large))-1)
+
+		require.NoError(t, c1.Put(ctx, "small", small, Meta{}))
+		require.NoError(t, c2.Put(ctx, "large", large, Meta{}))
+
+		_, found := c1.Stat("small")
+		require.False(t, found)
+		require.Len(t, c1.Entries(), 1)
+		require.Equal(t, c1.Entries()[0].Size, getDirSize(s))
+	})
+
+	t.Run("replace by other process", func(t *testing.T) {
+		c1, c2, s := newShared(t, 100000)
+
+		require.NoError(t, c1.Put(ctx, "image", small, Meta{}))
+		require.NoError(t, c2.Put(ctx, "image", large, Meta{}))
+
+		data, _, err := c1.Get(ctx, "image")
+		require.NoError(t, err)
+		require.Equal(t, large, data)
+		require.Equal(t, c1.Entries()[0].Size, getDirSize(s))
+	})
+
+	t.Run("compacted index is reloaded", func(t *testing.T) {
+		c1, c2, _ := newShared(t, 100000)
+
+		require.NoError(t, c1.Put(ctx, "small", small, Meta{}))
+		require.NoError(t, c1.Put(ctx, "large", large, Meta{}))
+		_, err := c1.Delete("large")
+		require.NoError(t, err)
+
+		_, found := c2.Stat("small")
+		require.True(t, found)
+
+		// Save compacts shared index.
+		require.NoError(t, c1.Save())
+		require.Equal(t, 1, c1.journal.records)
+
+		require.NoError(t, c1.Put(ctx, "large", large, Meta{}))
+
+		entries := c2.Entries()
+		require.Len(t, entries, 2)
+		require.Equal(t, "large", entries[0].Key)
+	})
+
+	t.Run("manifest is imported by first process", func(t *testing.T) {
+		path, index := t.TempDir(), t.TempDir()
+
+		s, _ := store.New(path, true)
+		c := New(100000, s)
+		require.NoError(t, c.Put(ctx, "small", small, Meta{}))
+		require.NoError(t, c.Save())
+
+		c1 := New(100000, s, WithShared(index))
+		require.NoError(t, c1.Load())
+		defer c1.Close()
+
+		c2 := New(100000, s, WithShared(index))
+		require.NoError(t, c2.Load())
+		defer c2.Close()
+
+		_, found := c2.Stat("small")
+		require.True(t, found)
+	})
+
+	t.Run("partial record is dropped", func(t *testing.T) {
+		c1, c2, _ := newShared(t, 100000)
+
+		require.NoError(t, c1.Put(ctx, "small", small, Meta{}))
+
+		// Interrupted append.
+		f, err := os.OpenFile(filepath.Join(c1.sharedDir, journalName), os.O_WRONLY|os.O_APPEND, 0o600)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"op":"put","key":"large"`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		require.NoError(t, c2.Put(ctx, "large", large, Meta{}))
+
+		entries := c1.Entries()
+		require.Len(t, entries, 2)
+		require.Equal(t, "large", entries[0].Key)
+	})
+}
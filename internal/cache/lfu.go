@@ -0,0 +1,110 @@
+package cache
+
+import "container/heap"
+
+// Least frequently used policy, least recent file is evicted among equally used.
+type lfu struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	tick  uint64 // logical clock for recency
+}
+
+type lfuItem struct {
+	key   string
+	freq  uint64
+	tick  uint64 // last access
+	index int    // heap index
+}
+
+// Min-heap by frequency, then by last access.
+type lfuHeap []*lfuItem
+
+func newLFU() *lfu {
+	return &lfu{
+		items: make(map[string]*lfuItem),
+	}
+}
+
+func (p *lfu) Add(key string, _ int64) {
+	p.tick++
+
+	// Replaced file keeps its frequency.
+	if item, exists := p.items[key]; exists {
+		item.freq++
+		item.tick = p.tick
+		heap.Fix(&p.heap, item.index)
+
+		return
+	}
+
+	item := &lfuItem{key: key, freq: 1, tick: p.tick}
+	heap.Push(&p.heap, item)
+	p.items[key] = item
+}
+
+func (p *lfu) Access(key string) {
+	item, exists := p.items[key]
+	if !exists {
+		return
+	}
+
+	p.tick++
+	item.freq++
+	item.tick = p.tick
+	heap.Fix(&p.heap, item.index)
+}
+
+func (p *lfu) Remove(key string) {
+	item, exists := p.items[key]
+	if !exists {
+		return
+	}
+
+	heap.Remove(&p.heap, item.index)
+	delete(p.items, key)
+}
+
+func (p *lfu) Evict() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+
+	item, _ := heap.Pop(&p.heap).(*lfuItem)
+	delete(p.items, item.key)
+
+	return item.key, true
+}
+
+func (h lfuHeap) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item, _ := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return item
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package cache
+
+import "os"
+
+// Shared cache requires file locks, which are not supported.
+const SharedSupported = false
+
+// File lock modes.
+const (
+	lockShared = iota
+	lockExclusive
+)
+
+func flock(*os.File, int) error {
+	return ErrSharedUnsupported
+}
+
+func funlock(*os.File) error {
+	return ErrSharedUnsupported
+}
@@ -0,0 +1,82 @@
+package cache
+
+// In-memory layer of hot files over disk storage. Nil memory layer keeps nothing.
+type memory struct {
+	size   int64 // max size in bytes
+	used   int64
+	files  map[string][]byte
+	policy Policy
+}
+
+func newMemory(size int64, policy Policy) *memory {
+	return &memory{
+		size:   size,
+		files:  make(map[string][]byte),
+		policy: policy,
+	}
+}
+
+// Get file data, it is shared and must not be modified.
+func (m *memory) get(key string) ([]byte, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.policy.Access(key)
+	data, exists := m.files[key]
+
+	return data, exists
+}
+
+// Put file, evicting files chosen by policy. Files larger than layer are not kept.
+func (m *memory) put(key string, data []byte) {
+	if m == nil {
+		return
+	}
+
+	m.remove(key)
+
+	size := int64(len(data))
+	if size > m.size {
+		return
+	}
+
+	for m.used+size > m.size {
+		victim, ok := m.policy.Evict()
+		if !ok {
+			break
+		}
+
+		m.used -= int64(len(m.files[victim]))
+		delete(m.files, victim)
+	}
+
+	m.files[key] = data
+	m.used += size
+	m.policy.Add(key, size)
+}
+
+// Remove file.
+func (m *memory) remove(key string) {
+	if m == nil {
+		return
+	}
+
+	data, exists := m.files[key]
+	if !exists {
+		return
+	}
+
+	m.used -= int64(len(data))
+	delete(m.files, key)
+	m.policy.Remove(key)
+}
+
+// Get used size in bytes.
+func (m *memory) usage() int64 {
+	if m == nil {
+		return 0
+	}
+
+	return m.used
+}
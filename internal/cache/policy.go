@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Eviction policy names.
+const (
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyARC     = "arc"
+	PolicyTinyLFU = "tinylfu"
+)
+
+var ErrUnknownPolicy = errors.New("unknown cache eviction policy")
+
+// Eviction policy, tracks cached files and chooses which one to evict,
+// when cache is full. Policy is called with cache lock held.
+type Policy interface {
+	// File put to cache.
+	Add(key string, size int64)
+	// File requested, it may be not cached.
+	Access(key string)
+	// File removed from cache not by policy, e.g. expired or purged.
+	Remove(key string)
+	// Choose and forget file to evict, false if no files tracked.
+	Evict() (string, bool)
+}
+
+// Create eviction policy by name for cache of given size in bytes.
+func NewPolicy(name string, size int64) (Policy, error) {
+	switch strings.ToLower(name) {
+	case PolicyLRU:
+		return newLRU(), nil
+	case PolicyLFU:
+		return newLFU(), nil
+	case PolicyARC:
+		return newARC(size), nil
+	case PolicyTinyLFU:
+		return newTinyLFU(size), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownPolicy, name)
+}
+
+// List of keys from most to least recent, with total size.
+type keyList struct {
+	queue *queue
+	items map[string]*item
+}
+
+func newKeyList() *keyList {
+	return &keyList{
+		queue: newQueue(),
+		items: make(map[string]*item),
+	}
+}
+
+// Check if key is in list.
+func (l *keyList) has(key string) bool {
+	_, exists := l.items[key]
+
+	return exists
+}
+
+// Get total size of keys.
+func (l *keyList) size() int64 {
+	return l.queue.size
+}
+
+// Get number of keys.
+func (l *keyList) len() int {
+	return len(l.items)
+}
+
+// Insert key to front.
+func (l *keyList) push(key string, size int64) {
+	l.queue.pushFront(file{url: key, size: size})
+	l.items[key] = l.queue.getFront()
+}
+
+// Move key to front.
+func (l *keyList) touch(key string) {
+	item, exists := l.items[key]
+	if !exists {
+		return
+	}
+
+	l.queue.moveToFront(item)
+	l.items[key] = l.queue.getFront()
+}
+
+// Remove key, returns its size.
+func (l *keyList) remove(key string) (int64, bool) {
+	item, exists := l.items[key]
+	if !exists {
+		return 0, false
+	}
+
+	delete(l.items, key)
+	l.queue.remove(item)
+
+	return item.file.size, true
+}
+
+// Get least recent key and its size.
+func (l *keyList) back() (string, int64, bool) {
+	item := l.queue.getBack()
+	if item == nil {
+		return "", 0, false
+	}
+
+	return item.file.url, item.file.size, true
+}
+
+// Remove least recent key.
+func (l *keyList) pop() (string, int64, bool) {
+	key, size, ok := l.back()
+	if ok {
+		l.remove(key)
+	}
+
+	return key, size, ok
+}
+
+// Least recently used policy.
+type lru struct {
+	list *keyList
+}
+
+func newLRU() *lru {
+	return &lru{newKeyList()}
+}
+
+func (p *lru) Add(key string, size int64) {
+	p.list.remove(key)
+	p.list.push(key, size)
+}
+
+func (p *lru) Access(key string) {
+	p.list.touch(key)
+}
+
+func (p *lru) Remove(key string) {
+	p.list.remove(key)
+}
+
+func (p *lru) Evict() (string, bool) {
+	key, _, ok := p.list.pop()
+
+	return key, ok
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	store "github.com/yakuninmax/imgpreviewer/internal/storage"
+)
+
+func TestPolicy(t *testing.T) {
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := NewPolicy("fifo", 100)
+		require.ErrorIs(t, err, ErrUnknownPolicy)
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		p, err := NewPolicy(PolicyLRU, 100)
+		require.NoError(t, err)
+
+		p.Add("a", 10)
+		p.Add("b", 10)
+		p.Add("c", 10)
+		p.Access("a")
+		p.Remove("b")
+
+		require.Equal(t, []string{"c", "a"}, evictAll(p))
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		p, err := NewPolicy(PolicyLFU, 100)
+		require.NoError(t, err)
+
+		p.Add("a", 10)
+		p.Add("b", 10)
+		p.Add("c", 10)
+		p.Access("a")
+		p.Access("a")
+		p.Access("c")
+
+		require.Equal(t, []string{"b", "c", "a"}, evictAll(p))
+	})
+
+	t.Run("arc", func(t *testing.T) {
+		p, err := NewPolicy(PolicyARC, 30)
+		require.NoError(t, err)
+
+		p.Add("a", 10)
+		p.Add("b", 10)
+		p.Access("a")
+
+		// Files seen once are evicted first.
+		key, ok := p.Evict()
+		require.True(t, ok)
+		require.Equal(t, "b", key)
+
+		// Recently evicted file returns to frequent list, and recent list target grows.
+		p.Add("b", 10)
+		p.Add("c", 10)
+
+		require.Equal(t, []string{"a", "b", "c"}, evictAll(p))
+	})
+
+	t.Run("tinylfu", func(t *testing.T) {
+		p, err := NewPolicy(PolicyTinyLFU, 1000)
+		require.NoError(t, err)
+
+		// Hot files.
+		for _, key := range []string{"a", "b"} {
+			p.Access(key)
+			p.Add(key, 100)
+			p.Access(key)
+			p.Access(key)
+		}
+
+		// One-hit scan does not evict hot files.
+		var evicted []string
+		for i := 0; i < 20; i++ {
+			key := "scan" + strconv.Itoa(i)
+
+			p.Access(key)
+			if i >= 8 {
+				k, ok := p.Evict()
+				require.True(t, ok)
+				evicted = append(evicted, k)
+			}
+			p.Add(key, 100)
+		}
+
+		require.NotContains(t, evicted, "a")
+		require.NotContains(t, evicted, "b")
+	})
+
+	t.Run("cache with policy", func(t *testing.T) {
+		ctx := context.Background()
+		s, _ := store.New("/tmp/test", false)
+
+		p, err := NewPolicy(PolicyLFU, 100000)
+		require.NoError(t, err)
+		c := New(100000, s, WithPolicy(p))
+
+		d, _ := os.ReadFile("../../examples/gopher_256x126.jpg")
+
+		require.NoError(t, c.Put(ctx, "hot", d, Meta{}))
+		for i := 0; i < 3; i++ {
+			_, _, err := c.Get(ctx, "hot")
+			require.NoError(t, err)
+		}
+
+		// Scan is larger than cache.
+		for i := 0; i < 20; i++ {
+			require.NoError(t, c.Put(ctx, "scan"+strconv.Itoa(i), d, Meta{}))
+		}
+
+		require.Contains(t, c.files, "hot")
+		require.LessOrEqual(t, c.queue.size, c.size)
+
+		_ = s.Clean()
+	})
+}
+
+// Evict all files, returns eviction order.
+func evictAll(p Policy) []string {
+	var keys []string
+	for {
+		key, ok := p.Evict()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, key)
+	}
+}
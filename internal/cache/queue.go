@@ -2,6 +2,7 @@ package cache
 
 type queue struct {
 	size  int64 // current cache size in bytes
+	count int   // current number of files
 	front *item
 	back  *item
 }
@@ -32,8 +33,8 @@ func (q *queue) pushFront(file file) {
 	item := new(item)
 	item.file = file
 
-	// Check if list is empty.
-	if q.size == 0 {
+	// Check if list is empty, it may hold empty files.
+	if q.front == nil {
 		q.back = item
 	} else {
 		item.next = q.front
@@ -44,6 +45,7 @@ func (q *queue) pushFront(file file) {
 	q.front = item
 
 	q.size += file.size
+	q.count++
 }
 
 // Remove item.
@@ -74,6 +76,7 @@ func (q *queue) remove(item *item) {
 	}
 
 	q.size -= item.file.size
+	q.count--
 }
 
 // Move item to front.
@@ -75,6 +75,7 @@ func TestQueue(t *testing.T) {
 		}
 
 		require.Equal(t, int64(464367), q.size)
+		require.Equal(t, len(testFiles), q.count)
 		require.Equal(t, testFiles[7], q.getFront().file)
 		require.Equal(t, testFiles[0], q.getBack().file)
 	})
@@ -90,6 +91,7 @@ func TestQueue(t *testing.T) {
 			q.moveToFront(q.getBack())
 
 			require.Equal(t, int64(464367), q.size)
+			require.Equal(t, len(testFiles), q.count)
 			require.Equal(t, testFiles[i], q.getFront().file)
 			require.Equal(t, testFiles[i+1], q.getBack().file)
 		}
@@ -111,6 +113,7 @@ func TestQueue(t *testing.T) {
 		q.remove(q.getBack())
 
 		require.Equal(t, 464367-testFiles[7].size-testFiles[0].size, q.size)
+		require.Equal(t, len(testFiles)-2, q.count)
 		require.Equal(t, testFiles[6], q.getFront().file)
 		require.Equal(t, testFiles[1], q.getBack().file)
 	})
@@ -0,0 +1,217 @@
+package cache
+
+import "hash/fnv"
+
+// W-TinyLFU sizes, in percents.
+const (
+	windowPercent    = 1  // admission window share of cache size
+	protectedPercent = 80 // protected segment share of main cache size
+)
+
+// Frequency sketch sizes.
+const (
+	sketchDepth     = 4
+	sketchMaxCount  = 15
+	sketchMinWidth  = 1 << 10
+	sketchMaxWidth  = 1 << 20
+	sketchFileSize  = 4 << 10 // expected average file size, to estimate files count
+	sketchResetMult = 10      // counters are halved after width*mult increments
+)
+
+// Window TinyLFU policy. New files enter small LRU window, files leaving window
+// are admitted to main segmented LRU only if they are used more often than main
+// cache victim, so one-hit scans do not flush frequently used files.
+type tinyLFU struct {
+	window     *keyList
+	probation  *keyList // main segment, seen once in main
+	protected  *keyList // main segment, seen again in main
+	windowSize int64
+	mainSize   int64
+	protSize   int64
+	sketch     *sketch
+}
+
+func newTinyLFU(size int64) *tinyLFU {
+	window := max(1, size*windowPercent/100)
+	main := size - window
+
+	return &tinyLFU{
+		window:     newKeyList(),
+		probation:  newKeyList(),
+		protected:  newKeyList(),
+		windowSize: window,
+		mainSize:   main,
+		protSize:   main * protectedPercent / 100,
+		sketch:     newSketch(size / sketchFileSize),
+	}
+}
+
+// Add file to window, its frequency is counted on access.
+func (p *tinyLFU) Add(key string, size int64) {
+	p.Remove(key)
+	p.window.push(key, size)
+
+	// Move files leaving window to main cache, while it has space.
+	for p.window.size() > p.windowSize && p.window.len() > 1 {
+		cand, csize, _ := p.window.back()
+		if p.probation.size()+p.protected.size()+csize > p.mainSize {
+			break
+		}
+
+		p.window.remove(cand)
+		p.probation.push(cand, csize)
+	}
+}
+
+func (p *tinyLFU) Access(key string) {
+	p.sketch.increment(key)
+
+	switch {
+	case p.window.has(key):
+		p.window.touch(key)
+
+	// Promote to protected segment, demote its least recent files.
+	case p.probation.has(key):
+		size, _ := p.probation.remove(key)
+		p.protected.push(key, size)
+
+		for p.protected.size() > p.protSize && p.protected.len() > 1 {
+			k, s, _ := p.protected.pop()
+			p.probation.push(k, s)
+		}
+
+	case p.protected.has(key):
+		p.protected.touch(key)
+	}
+}
+
+func (p *tinyLFU) Remove(key string) {
+	p.window.remove(key)
+	p.probation.remove(key)
+	p.protected.remove(key)
+}
+
+func (p *tinyLFU) Evict() (string, bool) {
+	// Window is oversized, window candidate competes with main cache victim.
+	if p.window.size() > p.windowSize {
+		cand, csize, _ := p.window.back()
+
+		victim, ok := p.mainVictim()
+		if !ok {
+			p.window.pop()
+			return cand, true
+		}
+
+		// Admit candidate, if it is used more often.
+		if p.sketch.estimate(cand) > p.sketch.estimate(victim) {
+			p.probation.remove(victim)
+			p.protected.remove(victim)
+			p.window.remove(cand)
+			p.probation.push(cand, csize)
+
+			return victim, true
+		}
+
+		p.window.pop()
+
+		return cand, true
+	}
+
+	if victim, ok := p.mainVictim(); ok {
+		p.probation.remove(victim)
+		p.protected.remove(victim)
+
+		return victim, true
+	}
+
+	key, _, ok := p.window.pop()
+
+	return key, ok
+}
+
+// Get least recent file of main cache, probation segment first.
+func (p *tinyLFU) mainVictim() (string, bool) {
+	if key, _, ok := p.probation.back(); ok {
+		return key, true
+	}
+
+	key, _, ok := p.protected.back()
+
+	return key, ok
+}
+
+// Count-min sketch of keys frequency, with 4-bit counters and periodic aging.
+type sketch struct {
+	rows    [sketchDepth][]uint8
+	mask    uint64
+	added   int
+	resetAt int
+}
+
+// Create sketch for expected number of keys.
+func newSketch(keys int64) *sketch {
+	width := uint64(sketchMinWidth)
+	for width < uint64(keys) && width < sketchMaxWidth {
+		width <<= 1
+	}
+
+	s := &sketch{
+		mask:    width - 1,
+		resetAt: int(width) * sketchResetMult,
+	}
+
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+// Increment key counters, halve all counters periodically.
+func (s *sketch) increment(key string) {
+	h1, h2 := hashKey(key)
+
+	for i := range s.rows {
+		idx := (h1 + uint64(i)*h2) & s.mask
+		if s.rows[i][idx] < sketchMaxCount {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.added++
+	if s.added >= s.resetAt {
+		s.reset()
+	}
+}
+
+// Get estimated key frequency.
+func (s *sketch) estimate(key string) uint8 {
+	h1, h2 := hashKey(key)
+
+	est := uint8(sketchMaxCount)
+	for i := range s.rows {
+		est = min(est, s.rows[i][(h1+uint64(i)*h2)&s.mask])
+	}
+
+	return est
+}
+
+// Halve all counters, so old popularity fades.
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+
+	s.added /= 2
+}
+
+// Get two independent hashes of key.
+func hashKey(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+
+	return sum, (sum >> 32) | 1
+}
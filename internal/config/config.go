@@ -3,27 +3,91 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/storage"
 )
 
 const (
 	cacheSizeEnv          = "IMPR_CACHE_SIZE"
+	sourceCacheSizeEnv    = "IMPR_SOURCE_CACHE_SIZE"
+	cacheMaxFilesEnv      = "IMPR_CACHE_MAX_FILES"
+	sourceMaxFilesEnv     = "IMPR_SOURCE_CACHE_MAX_FILES"
+	cacheMemorySizeEnv    = "IMPR_CACHE_MEMORY_SIZE"
+	sourceMemorySizeEnv   = "IMPR_SOURCE_CACHE_MEMORY_SIZE"
+	memoryPolicyEnv       = "IMPR_CACHE_MEMORY_POLICY"
 	cachePathEnv          = "IMPR_CACHE_PATH"
+	cachePersistentEnv    = "IMPR_CACHE_PERSISTENT"
+	cacheSyncEnv          = "IMPR_CACHE_SYNC"
+	cacheFanOutEnv        = "IMPR_CACHE_FANOUT"
+	cacheStorageEnv       = "IMPR_CACHE_STORAGE"
+	cacheSharedEnv        = "IMPR_CACHE_SHARED"
+	s3EndpointEnv         = "IMPR_S3_ENDPOINT"
+	s3RegionEnv           = "IMPR_S3_REGION"
+	s3BucketEnv           = "IMPR_S3_BUCKET"
+	s3PrefixEnv           = "IMPR_S3_PREFIX"
+	s3AccessKeyEnv        = "IMPR_S3_ACCESS_KEY"
+	s3SecretKeyEnv        = "IMPR_S3_SECRET_KEY"
 	requestTimeoutEnv     = "IMPR_REQ_TIMEOUT"
+	dialTimeoutEnv        = "IMPR_DIAL_TIMEOUT"
+	tlsTimeoutEnv         = "IMPR_TLS_TIMEOUT"
+	respHeaderTimeoutEnv  = "IMPR_RESP_HEADER_TIMEOUT"
+	keepAliveEnv          = "IMPR_KEEP_ALIVE"
+	idleConnTimeoutEnv    = "IMPR_IDLE_CONN_TIMEOUT"
+	maxIdleConnsEnv       = "IMPR_MAX_IDLE_CONNS_PER_HOST"
+	http2Env              = "IMPR_HTTP2"
+	proxyErrorsEnv        = "IMPR_PROXY_ERRORS"
+	maxAgeEnv             = "IMPR_HTTP_MAX_AGE"
+	legacyMaxAgeEnv       = "IMPR_CACHE_MAX_AGE" // deprecated, confused with IMPR_CACHE_TTL
+	sourceTTLEnv          = "IMPR_SOURCE_TTL"
+	cacheTTLEnv           = "IMPR_CACHE_TTL"
+	cacheIdleTimeoutEnv   = "IMPR_CACHE_IDLE_TIMEOUT"
+	janitorIntervalEnv    = "IMPR_CACHE_JANITOR_INTERVAL"
+	cachePolicyEnv        = "IMPR_CACHE_POLICY"
 	serverPort            = "IMPR_PORT"
+	adminPortEnv          = "IMPR_ADMIN_PORT"
+	adminTokenEnv         = "IMPR_ADMIN_TOKEN"
+	peersEnv              = "IMPR_PEERS"
+	metricsHostsEnv       = "IMPR_METRICS_HOSTS"
+	peerSelfEnv           = "IMPR_PEER_SELF"
+	peerSecretEnv         = "IMPR_PEER_SECRET"
 	defaultSereverPort    = "8080"
+	defaultAdminPort      = "8081"
 	defaultCacheSize      = 10485760
 	defaultCachePath      = "/tmp/impr_cache"
 	defaultRequestTimeout = 10
+	defaultDialTimeout    = 5
+	defaultTLSTimeout     = 5
+	defaultRespHdrTimeout = 10
+	defaultKeepAlive      = 30
+	defaultIdleConnTO     = 90
+	defaultMaxIdleConns   = 16
+	defaultHTTP2          = true
+	defaultMaxAge         = 86400
+	defaultSourceTTL      = 3600
+	defaultJanitorInt     = 60
+	defaultCachePolicy    = "lru"
+	defaultCacheFanOut    = 2
+	defaultCacheStorage   = storage.BackendFS
 )
 
 var (
 	ErrCacheSizeZeroOrLess      = errors.New("cache size is zero or less")
 	ErrRequestTimeoutZeroOrLess = errors.New("request timeout is zero or less")
 	ErrInvalidPort              = errors.New("invalid port number")
+	ErrValueZeroOrLess          = errors.New("value is zero or less")
+	ErrInvalidFanOut            = errors.New("invalid cache fan-out levels")
+	ErrS3NotConfigured          = errors.New("s3 endpoint or bucket is not set")
+	ErrSharedStorage            = errors.New("shared cache requires fs or s3 storage")
+	ErrInvalidPeer              = errors.New("invalid peer url")
+	ErrPeerSelfNotSet           = errors.New("peer self url is not set")
+	ErrPeerSecretNotSet         = errors.New("peer secret is not set")
 )
 
 type logger interface {
@@ -35,9 +99,56 @@ type logger interface {
 
 type Config struct {
 	cacheSize      int64
+	sourceCache    int64
+	cacheFiles     int
+	sourceFiles    int
+	cacheMemory    int64
+	sourceMemory   int64
+	memoryPolicy   string
 	cachePath      string
+	persistent     bool
+	cacheSync      bool
+	cacheFanOut    int
+	cacheStorage   string
+	cacheShared    bool
+	s3             S3Config
 	requestTimeout time.Duration
+	client         ClientConfig
 	serverPort     string
+	proxyErrors    bool
+	maxAge         time.Duration
+	sourceTTL      time.Duration
+	cacheTTL       time.Duration
+	idleTimeout    time.Duration
+	janitor        time.Duration
+	adminPort      string
+	adminToken     string
+	cachePolicy    string
+	peers          []string
+	peerSelf       string
+	peerSecret     string
+	metricsHosts   []string
+}
+
+// S3 storage config.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// Http client config.
+type ClientConfig struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	KeepAlive             time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+	HTTP2                 bool
 }
 
 func New(logg logger) (*Config, error) {
@@ -46,26 +157,199 @@ func New(logg logger) (*Config, error) {
 		return nil, err
 	}
 
+	sc, err := getMegabytes(logg, sourceCacheSizeEnv, defaultCacheSize/1024/1024)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cached files number is not limited by default.
+	cf, err := getPositiveInt(logg, cacheMaxFilesEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err := getPositiveInt(logg, sourceMaxFilesEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Memory layer is disabled by default.
+	cm, err := getMegabytes(logg, cacheMemorySizeEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := getMegabytes(logg, sourceMemorySizeEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
 	cp, err := getCachePath(logg)
 	if err != nil {
 		return nil, err
 	}
 
+	pc, err := getCachePersistent(logg)
+	if err != nil {
+		return nil, err
+	}
+
+	cy, err := getBool(logg, cacheSyncEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	fo, err := getCacheFanOut(logg)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := os.Getenv(cacheStorageEnv)
+	if backend == "" {
+		logg.Debug(cacheStorageEnv + " value is empty, set default " + defaultCacheStorage)
+
+		backend = defaultCacheStorage
+	}
+
+	s3 := getS3Config()
+	if backend == storage.BackendS3 && (s3.Endpoint == "" || s3.Bucket == "") {
+		return nil, ErrS3NotConfigured
+	}
+
+	sh, err := getBool(logg, cacheSharedEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if sh && !cache.SharedSupported {
+		return nil, cache.ErrSharedUnsupported
+	}
+
+	if sh && backend != storage.BackendFS && backend != storage.BackendS3 {
+		return nil, ErrSharedStorage
+	}
+
 	rt, err := getRequestTimeout(logg)
 	if err != nil {
 		return nil, err
 	}
 
+	cc, err := getClientConfig(logg)
+	if err != nil {
+		return nil, err
+	}
+
 	sp, err := getServerPort(logg)
 	if err != nil {
 		return nil, err
 	}
 
+	pe, err := getBool(logg, proxyErrorsEnv, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Response max-age is set by old name, if new one is not set.
+	maEnv := maxAgeEnv
+	if os.Getenv(maxAgeEnv) == "" && os.Getenv(legacyMaxAgeEnv) != "" {
+		logg.Warn(legacyMaxAgeEnv + " is deprecated, use " + maxAgeEnv)
+
+		maEnv = legacyMaxAgeEnv
+	}
+
+	ma, err := getSeconds(logg, maEnv, defaultMaxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := getSeconds(logg, sourceTTLEnv, defaultSourceTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache entries expiration is disabled by default.
+	ct, err := getSeconds(logg, cacheTTLEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := getSeconds(logg, cacheIdleTimeoutEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ji, err := getSeconds(logg, janitorIntervalEnv, defaultJanitorInt)
+	if err != nil {
+		return nil, err
+	}
+
+	ap, err := getPort(logg, adminPortEnv, defaultAdminPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// Admin API is disabled without token.
+	at := os.Getenv(adminTokenEnv)
+	if at == "" {
+		logg.Info(adminTokenEnv + " value is empty, admin api disabled")
+	}
+
+	peers, self, err := getPeers(logg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests from other replicas are trusted by shared secret only.
+	ps := os.Getenv(peerSecretEnv)
+	if len(peers) > 0 && ps == "" {
+		return nil, ErrPeerSecretNotSet
+	}
+
+	policy := os.Getenv(cachePolicyEnv)
+	if policy == "" {
+		logg.Debug(cachePolicyEnv + " value is empty, set default " + defaultCachePolicy)
+
+		policy = defaultCachePolicy
+	}
+
+	memPolicy := os.Getenv(memoryPolicyEnv)
+	if memPolicy == "" {
+		logg.Debug(memoryPolicyEnv + " value is empty, set default " + defaultCachePolicy)
+
+		memPolicy = defaultCachePolicy
+	}
+
 	return &Config{
 		cacheSize:      cs,
+		sourceCache:    sc,
+		cacheFiles:     cf,
+		sourceFiles:    sf,
+		cacheMemory:    cm,
+		sourceMemory:   sm,
+		memoryPolicy:   memPolicy,
 		cachePath:      cp,
+		persistent:     pc,
+		cacheSync:      cy,
+		cacheFanOut:    fo,
+		cacheStorage:   backend,
+		cacheShared:    sh,
+		s3:             s3,
 		requestTimeout: rt,
+		client:         cc,
 		serverPort:     sp,
+		proxyErrors:    pe,
+		maxAge:         ma,
+		sourceTTL:      st,
+		cacheTTL:       ct,
+		idleTimeout:    it,
+		janitor:        ji,
+		adminPort:      ap,
+		adminToken:     at,
+		cachePolicy:    policy,
+		peers:          peers,
+		peerSelf:       self,
+		peerSecret:     ps,
+		metricsHosts:   getList(os.Getenv(metricsHostsEnv)),
 	}, nil
 }
 
@@ -73,18 +357,145 @@ func (c *Config) CacheSize() int64 {
 	return c.cacheSize
 }
 
+func (c *Config) SourceCacheSize() int64 {
+	return c.sourceCache
+}
+
+// Get max number of cached previews, zero means unlimited.
+func (c *Config) CacheMaxFiles() int {
+	return c.cacheFiles
+}
+
+// Get max number of cached original images, zero means unlimited.
+func (c *Config) SourceCacheMaxFiles() int {
+	return c.sourceFiles
+}
+
+// Get size of previews memory layer in bytes, zero means disabled.
+func (c *Config) CacheMemorySize() int64 {
+	return c.cacheMemory
+}
+
+// Get size of original images memory layer in bytes, zero means disabled.
+func (c *Config) SourceCacheMemorySize() int64 {
+	return c.sourceMemory
+}
+
+// Get memory layer eviction policy name.
+func (c *Config) MemoryPolicy() string {
+	return c.memoryPolicy
+}
+
 func (c *Config) CachePath() string {
 	return c.cachePath
 }
 
+func (c *Config) CachePersistent() bool {
+	return c.persistent
+}
+
+// Flush cache files to disk on every write.
+func (c *Config) CacheSync() bool {
+	return c.cacheSync
+}
+
+// Number of nested cache dirs levels, zero means flat layout.
+func (c *Config) CacheFanOut() int {
+	return c.cacheFanOut
+}
+
+// Cache storage backend name.
+func (c *Config) CacheStorage() string {
+	return c.cacheStorage
+}
+
+// Share cache with other processes on the same host.
+func (c *Config) CacheShared() bool {
+	return c.cacheShared
+}
+
+func (c *Config) S3() S3Config {
+	return c.s3
+}
+
 func (c *Config) RequestTimeout() time.Duration {
 	return c.requestTimeout
 }
 
+func (c *Config) Client() ClientConfig {
+	return c.client
+}
+
 func (c *Config) Port() string {
 	return c.serverPort
 }
 
+func (c *Config) ProxyErrors() bool {
+	return c.proxyErrors
+}
+
+// Get max-age of responses for http clients. It does not affect cache
+// entries lifetime, see CacheTTL.
+func (c *Config) MaxAge() time.Duration {
+	return c.maxAge
+}
+
+// Get default lifetime of original images, used if remote server sets none.
+func (c *Config) SourceTTL() time.Duration {
+	return c.sourceTTL
+}
+
+// Get max age of cache entries, zero means unlimited. It does not affect
+// responses max-age, see MaxAge.
+func (c *Config) CacheTTL() time.Duration {
+	return c.cacheTTL
+}
+
+// Get max idle time of cache entries, zero means unlimited.
+func (c *Config) CacheIdleTimeout() time.Duration {
+	return c.idleTimeout
+}
+
+// Get interval of expired cache entries cleanup.
+func (c *Config) JanitorInterval() time.Duration {
+	return c.janitor
+}
+
+// Get cache eviction policy name.
+func (c *Config) CachePolicy() string {
+	return c.cachePolicy
+}
+
+// Get origin hosts with own download metrics, other hosts share one label.
+func (c *Config) MetricsHosts() []string {
+	return c.metricsHosts
+}
+
+// Get other replicas base urls, empty list disables peers.
+func (c *Config) Peers() []string {
+	return c.peers
+}
+
+// Get this replica base url, as seen by other replicas.
+func (c *Config) PeerSelf() string {
+	return c.peerSelf
+}
+
+// Get secret, that authenticates requests between replicas.
+func (c *Config) PeerSecret() string {
+	return c.peerSecret
+}
+
+// Get admin API port.
+func (c *Config) AdminPort() string {
+	return c.adminPort
+}
+
+// Get admin API bearer token, empty means admin API is disabled.
+func (c *Config) AdminToken() string {
+	return c.adminToken
+}
+
 // Get cache size from env var.
 func getCacheSize(logg logger) (int64, error) {
 	env := os.Getenv(cacheSizeEnv)
@@ -138,6 +549,28 @@ func getCachePath(logg logger) (string, error) {
 	return path, nil
 }
 
+// Get cache persistence mode from env var.
+func getCachePersistent(logg logger) (bool, error) {
+	env := os.Getenv(cachePersistentEnv)
+
+	// Check if no env, or empty string.
+	if env == "" {
+		logg.Warn("IMPR_CACHE_PERSISTENT value is empty, cache will be cleared on shutdown")
+
+		return false, nil
+	}
+
+	// Convert string parameter.
+	pc, err := strconv.ParseBool(env)
+	if err != nil {
+		return false, fmt.Errorf("failed to set cache persistence: %w", err)
+	}
+
+	logg.Info("cache persistence is " + strconv.FormatBool(pc))
+
+	return pc, nil
+}
+
 // Get request timeout.
 func getRequestTimeout(logg logger) (time.Duration, error) {
 	env := os.Getenv(requestTimeoutEnv)
@@ -169,6 +602,214 @@ func getRequestTimeout(logg logger) (time.Duration, error) {
 	return time.Duration(to) * time.Second, nil
 }
 
+// Get http client config.
+func getClientConfig(logg logger) (ClientConfig, error) {
+	var (
+		cc  ClientConfig
+		err error
+	)
+
+	cc.DialTimeout, err = getSeconds(logg, dialTimeoutEnv, defaultDialTimeout)
+	if err != nil {
+		return cc, err
+	}
+
+	cc.TLSHandshakeTimeout, err = getSeconds(logg, tlsTimeoutEnv, defaultTLSTimeout)
+	if err != nil {
+		return cc, err
+	}
+
+	cc.ResponseHeaderTimeout, err = getSeconds(logg, respHeaderTimeoutEnv, defaultRespHdrTimeout)
+	if err != nil {
+		return cc, err
+	}
+
+	cc.KeepAlive, err = getSeconds(logg, keepAliveEnv, defaultKeepAlive)
+	if err != nil {
+		return cc, err
+	}
+
+	cc.IdleConnTimeout, err = getSeconds(logg, idleConnTimeoutEnv, defaultIdleConnTO)
+	if err != nil {
+		return cc, err
+	}
+
+	cc.MaxIdleConnsPerHost, err = getPositiveInt(logg, maxIdleConnsEnv, defaultMaxIdleConns)
+	if err != nil {
+		return cc, err
+	}
+
+	cc.HTTP2, err = getBool(logg, http2Env, defaultHTTP2)
+	if err != nil {
+		return cc, err
+	}
+
+	return cc, nil
+}
+
+// Get positive number of seconds from env var.
+func getSeconds(logg logger, name string, def int) (time.Duration, error) {
+	n, err := getPositiveInt(logg, name, def)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
+// Get positive number of megabytes from env var, in bytes.
+func getMegabytes(logg logger, name string, def int) (int64, error) {
+	n, err := getPositiveInt(logg, name, def)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n) * 1024 * 1024, nil
+}
+
+// Get positive integer from env var.
+func getPositiveInt(logg logger, name string, def int) (int, error) {
+	env := os.Getenv(name)
+
+	// Check if no env, or empty string.
+	if env == "" {
+		logg.Debug(name + " value is empty, set default " + strconv.Itoa(def))
+
+		return def, nil
+	}
+
+	// Convert string parameter.
+	n, err := strconv.Atoi(env)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set %s: %w", name, err)
+	}
+
+	if n <= 0 {
+		return 0, fmt.Errorf("failed to set %s: %w", name, ErrValueZeroOrLess)
+	}
+
+	logg.Info(name + " is " + env)
+
+	return n, nil
+}
+
+// Get boolean from env var.
+func getBool(logg logger, name string, def bool) (bool, error) {
+	env := os.Getenv(name)
+
+	// Check if no env, or empty string.
+	if env == "" {
+		logg.Debug(name + " value is empty, set default " + strconv.FormatBool(def))
+
+		return def, nil
+	}
+
+	// Convert string parameter.
+	b, err := strconv.ParseBool(env)
+	if err != nil {
+		return false, fmt.Errorf("failed to set %s: %w", name, err)
+	}
+
+	logg.Info(name + " is " + env)
+
+	return b, nil
+}
+
+// Get cache dirs fan-out levels.
+func getCacheFanOut(logg logger) (int, error) {
+	env := os.Getenv(cacheFanOutEnv)
+
+	// Check if no env, or empty string.
+	if env == "" {
+		logg.Debug(cacheFanOutEnv + " value is empty, set default " + strconv.Itoa(defaultCacheFanOut))
+
+		return defaultCacheFanOut, nil
+	}
+
+	// Convert string parameter.
+	n, err := strconv.Atoi(env)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set %s: %w", cacheFanOutEnv, err)
+	}
+
+	if n < 0 || n > storage.MaxFanOut {
+		return 0, fmt.Errorf("failed to set %s: %w", cacheFanOutEnv, ErrInvalidFanOut)
+	}
+
+	logg.Info(cacheFanOutEnv + " is " + env)
+
+	return n, nil
+}
+
+// Get peer replicas urls and this replica url, empty list disables peers.
+func getPeers(logg logger) ([]string, string, error) {
+	env := os.Getenv(peersEnv)
+	if env == "" {
+		logg.Debug(peersEnv + " value is empty, peers disabled")
+
+		return nil, "", nil
+	}
+
+	// Replicas must agree on keys owners, so this replica url must be known.
+	if os.Getenv(peerSelfEnv) == "" {
+		return nil, "", ErrPeerSelfNotSet
+	}
+
+	self, err := getPeerURL(os.Getenv(peerSelfEnv))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to set %s: %w", peerSelfEnv, err)
+	}
+
+	var peers []string
+	for _, p := range getList(env) {
+		u, err := getPeerURL(p)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to set %s: %w", peersEnv, err)
+		}
+
+		// This replica is added by peer pool itself.
+		if u != self {
+			peers = append(peers, u)
+		}
+	}
+
+	return peers, self, nil
+}
+
+// Split comma separated list, empty items are skipped.
+func getList(env string) []string {
+	var items []string
+	for _, item := range strings.Split(env, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Check peer base url, it is returned without trailing slash.
+func getPeerURL(s string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(s, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPeer, s)
+	}
+
+	return u.String(), nil
+}
+
+// Get S3 storage config.
+func getS3Config() S3Config {
+	return S3Config{
+		Endpoint:  os.Getenv(s3EndpointEnv),
+		Region:    os.Getenv(s3RegionEnv),
+		Bucket:    os.Getenv(s3BucketEnv),
+		Prefix:    os.Getenv(s3PrefixEnv),
+		AccessKey: os.Getenv(s3AccessKeyEnv),
+		SecretKey: os.Getenv(s3SecretKeyEnv),
+	}
+}
+
 // Get server port.
 func getServerPort(logg logger) (string, error) {
 	env := os.Getenv(serverPort)
@@ -180,8 +821,28 @@ func getServerPort(logg logger) (string, error) {
 		return defaultSereverPort, nil
 	}
 
-	// Check port number.
-	p, err := strconv.Atoi(env)
+	return checkPort(env)
+}
+
+// Get port from env var.
+func getPort(logg logger, name, def string) (string, error) {
+	env := os.Getenv(name)
+
+	// Check if no env, or empty string.
+	if env == "" {
+		logg.Debug(name + " value is empty, set default " + def)
+
+		return def, nil
+	}
+
+	logg.Info(name + " is " + env)
+
+	return checkPort(env)
+}
+
+// Check port number.
+func checkPort(port string) (string, error) {
+	p, err := strconv.Atoi(port)
 	if err != nil {
 		return "", err
 	}
@@ -190,5 +851,5 @@ func getServerPort(logg logger) (string, error) {
 		return "", ErrInvalidPort
 	}
 
-	return env, nil
+	return port, nil
 }
@@ -15,35 +15,153 @@ func TestConfig(t *testing.T) {
 
 	t.Run("get default values", func(t *testing.T) {
 		os.Unsetenv("IMPR_CACHE_SIZE")
+		os.Unsetenv("IMPR_SOURCE_CACHE_SIZE")
 		os.Unsetenv("IMPR_CACHE_PATH")
+		os.Unsetenv("IMPR_CACHE_PERSISTENT")
 		os.Unsetenv("IMPR_REQ_TIMEOUT")
 		os.Unsetenv("IMPR_PORT")
 
 		conf, err := New(logg)
 		require.NoError(t, err)
 		require.Equal(t, defaultCachePath, conf.cachePath)
+		require.False(t, conf.persistent)
+		require.False(t, conf.cacheSync)
+		require.Equal(t, defaultCacheFanOut, conf.cacheFanOut)
+		require.Equal(t, defaultCacheStorage, conf.cacheStorage)
+		require.False(t, conf.cacheShared)
 		require.Equal(t, int64(defaultCacheSize), conf.cacheSize)
+		require.Equal(t, int64(defaultCacheSize), conf.sourceCache)
 		require.Equal(t, defaultRequestTimeout*time.Second, conf.requestTimeout)
 		require.Equal(t, defaultSereverPort, conf.serverPort)
+		require.False(t, conf.proxyErrors)
+		require.Equal(t, defaultMaxAge*time.Second, conf.maxAge)
+		require.Equal(t, defaultSourceTTL*time.Second, conf.sourceTTL)
+		require.Zero(t, conf.cacheTTL)
+		require.Zero(t, conf.idleTimeout)
+		require.Empty(t, conf.peers)
+		require.Equal(t, defaultJanitorInt*time.Second, conf.janitor)
+		require.Equal(t, defaultAdminPort, conf.adminPort)
+		require.Empty(t, conf.adminToken)
+		require.Equal(t, defaultCachePolicy, conf.cachePolicy)
+		require.Zero(t, conf.cacheFiles)
+		require.Zero(t, conf.sourceFiles)
+		require.Zero(t, conf.cacheMemory)
+		require.Zero(t, conf.sourceMemory)
+		require.Equal(t, defaultCachePolicy, conf.memoryPolicy)
+		require.Equal(t, ClientConfig{
+			DialTimeout:           defaultDialTimeout * time.Second,
+			TLSHandshakeTimeout:   defaultTLSTimeout * time.Second,
+			ResponseHeaderTimeout: defaultRespHdrTimeout * time.Second,
+			KeepAlive:             defaultKeepAlive * time.Second,
+			IdleConnTimeout:       defaultIdleConnTO * time.Second,
+			MaxIdleConnsPerHost:   defaultMaxIdleConns,
+			HTTP2:                 defaultHTTP2,
+		}, conf.client)
 	})
 
 	t.Run("set values", func(t *testing.T) {
 		os.Setenv("IMPR_CACHE_SIZE", "100")
+		os.Setenv("IMPR_SOURCE_CACHE_SIZE", "200")
 		os.Setenv("IMPR_CACHE_PATH", "/tmp/test123")
+		os.Setenv("IMPR_CACHE_PERSISTENT", "true")
+		os.Setenv("IMPR_CACHE_SYNC", "true")
+		os.Setenv("IMPR_CACHE_FANOUT", "0")
+		os.Setenv("IMPR_CACHE_STORAGE", "s3")
+		os.Setenv("IMPR_CACHE_SHARED", "true")
+		os.Setenv("IMPR_S3_ENDPOINT", "http://minio:9000")
+		os.Setenv("IMPR_S3_BUCKET", "cache")
+		os.Setenv("IMPR_S3_ACCESS_KEY", "key")
+		os.Setenv("IMPR_S3_SECRET_KEY", "secret")
 		os.Setenv("IMPR_REQ_TIMEOUT", "60")
 		os.Setenv("IMPR_PORT", "48080")
+		os.Setenv("IMPR_PROXY_ERRORS", "true")
+		os.Setenv("IMPR_HTTP_MAX_AGE", "3600")
+		os.Setenv("IMPR_SOURCE_TTL", "600")
+		os.Setenv("IMPR_CACHE_TTL", "86400")
+		os.Setenv("IMPR_CACHE_IDLE_TIMEOUT", "7200")
+		os.Setenv("IMPR_CACHE_JANITOR_INTERVAL", "30")
+		os.Setenv("IMPR_ADMIN_PORT", "9090")
+		os.Setenv("IMPR_ADMIN_TOKEN", "secret")
+		os.Setenv("IMPR_PEERS", "http://10.0.0.1:8080/, http://10.0.0.2:8080,http://10.0.0.3:8080")
+		os.Setenv("IMPR_PEER_SELF", "http://10.0.0.3:8080")
+		os.Setenv("IMPR_PEER_SECRET", "peer-secret")
+		os.Setenv("IMPR_METRICS_HOSTS", "example.com, cdn.example.com:8080,")
+		os.Setenv("IMPR_CACHE_POLICY", "tinylfu")
+		os.Setenv("IMPR_CACHE_MAX_FILES", "100000")
+		os.Setenv("IMPR_SOURCE_CACHE_MAX_FILES", "1000")
+		os.Setenv("IMPR_CACHE_MEMORY_SIZE", "2")
+		os.Setenv("IMPR_SOURCE_CACHE_MEMORY_SIZE", "1")
+		os.Setenv("IMPR_CACHE_MEMORY_POLICY", "lfu")
 
 		conf, err := New(logg)
 		require.NoError(t, err)
 		require.Equal(t, "/tmp/test123", conf.cachePath)
+		require.True(t, conf.persistent)
+		require.True(t, conf.CacheSync())
+		require.Equal(t, 0, conf.CacheFanOut())
+		require.Equal(t, "s3", conf.CacheStorage())
+		require.True(t, conf.CacheShared())
+		require.Equal(t, S3Config{
+			Endpoint:  "http://minio:9000",
+			Bucket:    "cache",
+			AccessKey: "key",
+			SecretKey: "secret",
+		}, conf.S3())
 		require.Equal(t, int64(100*1024*1024), conf.cacheSize)
+		require.Equal(t, int64(200*1024*1024), conf.sourceCache)
 		require.Equal(t, 60*time.Second, conf.requestTimeout)
 		require.Equal(t, "48080", conf.serverPort)
+		require.True(t, conf.ProxyErrors())
+		require.Equal(t, time.Hour, conf.MaxAge())
+		require.Equal(t, 10*time.Minute, conf.SourceTTL())
+		require.Equal(t, 24*time.Hour, conf.CacheTTL())
+		require.Equal(t, 2*time.Hour, conf.CacheIdleTimeout())
+		require.Equal(t, 30*time.Second, conf.JanitorInterval())
+		require.Equal(t, "9090", conf.AdminPort())
+		require.Equal(t, "secret", conf.AdminToken())
+		require.Equal(t, "tinylfu", conf.CachePolicy())
+		require.Equal(t, 100000, conf.CacheMaxFiles())
+		require.Equal(t, 1000, conf.SourceCacheMaxFiles())
+		require.Equal(t, int64(2*1024*1024), conf.CacheMemorySize())
+		require.Equal(t, int64(1024*1024), conf.SourceCacheMemorySize())
+		require.Equal(t, "lfu", conf.MemoryPolicy())
+		require.Equal(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}, conf.Peers())
+		require.Equal(t, "http://10.0.0.3:8080", conf.PeerSelf())
+		require.Equal(t, "peer-secret", conf.PeerSecret())
+		require.Equal(t, []string{"example.com", "cdn.example.com:8080"}, conf.MetricsHosts())
 
 		os.Unsetenv("IMPR_CACHE_SIZE")
+		os.Unsetenv("IMPR_SOURCE_CACHE_SIZE")
 		os.Unsetenv("IMPR_CACHE_PATH")
+		os.Unsetenv("IMPR_CACHE_PERSISTENT")
+		os.Unsetenv("IMPR_CACHE_SYNC")
+		os.Unsetenv("IMPR_CACHE_FANOUT")
+		os.Unsetenv("IMPR_CACHE_STORAGE")
+		os.Unsetenv("IMPR_CACHE_SHARED")
+		os.Unsetenv("IMPR_S3_ENDPOINT")
+		os.Unsetenv("IMPR_S3_BUCKET")
+		os.Unsetenv("IMPR_S3_ACCESS_KEY")
+		os.Unsetenv("IMPR_S3_SECRET_KEY")
 		os.Unsetenv("IMPR_REQ_TIMEOUT")
 		os.Unsetenv("IMPR_PORT")
+		os.Unsetenv("IMPR_PROXY_ERRORS")
+		os.Unsetenv("IMPR_HTTP_MAX_AGE")
+		os.Unsetenv("IMPR_SOURCE_TTL")
+		os.Unsetenv("IMPR_CACHE_TTL")
+		os.Unsetenv("IMPR_CACHE_IDLE_TIMEOUT")
+		os.Unsetenv("IMPR_CACHE_JANITOR_INTERVAL")
+		os.Unsetenv("IMPR_ADMIN_PORT")
+		os.Unsetenv("IMPR_ADMIN_TOKEN")
+		os.Unsetenv("IMPR_PEERS")
+		os.Unsetenv("IMPR_PEER_SELF")
+		os.Unsetenv("IMPR_PEER_SECRET")
+		os.Unsetenv("IMPR_METRICS_HOSTS")
+		os.Unsetenv("IMPR_CACHE_POLICY")
+		os.Unsetenv("IMPR_CACHE_MAX_FILES")
+		os.Unsetenv("IMPR_SOURCE_CACHE_MAX_FILES")
+		os.Unsetenv("IMPR_CACHE_MEMORY_SIZE")
+		os.Unsetenv("IMPR_SOURCE_CACHE_MEMORY_SIZE")
+		os.Unsetenv("IMPR_CACHE_MEMORY_POLICY")
 	})
 
 	t.Run("invalid request timeout", func(t *testing.T) {
@@ -55,6 +173,15 @@ func TestConfig(t *testing.T) {
 		os.Unsetenv("IMPR_CACHE_SIZE")
 	})
 
+	t.Run("invalid source cache size", func(t *testing.T) {
+		os.Setenv("IMPR_SOURCE_CACHE_SIZE", "0")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrValueZeroOrLess)
+
+		os.Unsetenv("IMPR_SOURCE_CACHE_SIZE")
+	})
+
 	t.Run("invalid request timeout", func(t *testing.T) {
 		os.Setenv("IMPR_REQ_TIMEOUT", "-100")
 
@@ -64,6 +191,63 @@ func TestConfig(t *testing.T) {
 		os.Unsetenv("IMPR_REQ_TIMEOUT")
 	})
 
+	t.Run("set client values", func(t *testing.T) {
+		os.Setenv("IMPR_DIAL_TIMEOUT", "1")
+		os.Setenv("IMPR_TLS_TIMEOUT", "2")
+		os.Setenv("IMPR_RESP_HEADER_TIMEOUT", "3")
+		os.Setenv("IMPR_KEEP_ALIVE", "4")
+		os.Setenv("IMPR_IDLE_CONN_TIMEOUT", "5")
+		os.Setenv("IMPR_MAX_IDLE_CONNS_PER_HOST", "6")
+		os.Setenv("IMPR_HTTP2", "false")
+
+		conf, err := New(logg)
+		require.NoError(t, err)
+		require.Equal(t, ClientConfig{
+			DialTimeout:           1 * time.Second,
+			TLSHandshakeTimeout:   2 * time.Second,
+			ResponseHeaderTimeout: 3 * time.Second,
+			KeepAlive:             4 * time.Second,
+			IdleConnTimeout:       5 * time.Second,
+			MaxIdleConnsPerHost:   6,
+			HTTP2:                 false,
+		}, conf.Client())
+
+		os.Unsetenv("IMPR_DIAL_TIMEOUT")
+		os.Unsetenv("IMPR_TLS_TIMEOUT")
+		os.Unsetenv("IMPR_RESP_HEADER_TIMEOUT")
+		os.Unsetenv("IMPR_KEEP_ALIVE")
+		os.Unsetenv("IMPR_IDLE_CONN_TIMEOUT")
+		os.Unsetenv("IMPR_MAX_IDLE_CONNS_PER_HOST")
+		os.Unsetenv("IMPR_HTTP2")
+	})
+
+	t.Run("invalid client value", func(t *testing.T) {
+		os.Setenv("IMPR_DIAL_TIMEOUT", "0")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrValueZeroOrLess)
+
+		os.Unsetenv("IMPR_DIAL_TIMEOUT")
+	})
+
+	t.Run("deprecated max age", func(t *testing.T) {
+		os.Setenv("IMPR_CACHE_MAX_AGE", "600")
+
+		conf, err := New(logg)
+		require.NoError(t, err)
+		require.Equal(t, 10*time.Minute, conf.MaxAge())
+
+		// New name takes precedence.
+		os.Setenv("IMPR_HTTP_MAX_AGE", "60")
+
+		conf, err = New(logg)
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, conf.MaxAge())
+
+		os.Unsetenv("IMPR_CACHE_MAX_AGE")
+		os.Unsetenv("IMPR_HTTP_MAX_AGE")
+	})
+
 	t.Run("invalid port", func(t *testing.T) {
 		os.Setenv("IMPR_PORT", "76000")
 
@@ -71,5 +255,91 @@ func TestConfig(t *testing.T) {
 		require.ErrorIs(t, ErrInvalidPort, err)
 
 		os.Unsetenv("IMPR_PORT")
+		os.Unsetenv("IMPR_PROXY_ERRORS")
+		os.Unsetenv("IMPR_HTTP_MAX_AGE")
+		os.Unsetenv("IMPR_SOURCE_TTL")
+		os.Unsetenv("IMPR_CACHE_TTL")
+		os.Unsetenv("IMPR_CACHE_IDLE_TIMEOUT")
+		os.Unsetenv("IMPR_CACHE_JANITOR_INTERVAL")
+	})
+
+	t.Run("invalid max files", func(t *testing.T) {
+		os.Setenv("IMPR_CACHE_MAX_FILES", "-1")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrValueZeroOrLess)
+
+		os.Unsetenv("IMPR_CACHE_MAX_FILES")
+	})
+
+	t.Run("invalid cache fan-out", func(t *testing.T) {
+		os.Setenv("IMPR_CACHE_FANOUT", "4")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrInvalidFanOut)
+
+		os.Unsetenv("IMPR_CACHE_FANOUT")
+	})
+
+	t.Run("s3 storage without bucket", func(t *testing.T) {
+		os.Setenv("IMPR_CACHE_STORAGE", "s3")
+		os.Setenv("IMPR_S3_ENDPOINT", "http://minio:9000")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrS3NotConfigured)
+
+		os.Unsetenv("IMPR_CACHE_STORAGE")
+		os.Unsetenv("IMPR_S3_ENDPOINT")
+	})
+
+	t.Run("shared memory storage", func(t *testing.T) {
+		os.Setenv("IMPR_CACHE_STORAGE", "memory")
+		os.Setenv("IMPR_CACHE_SHARED", "true")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrSharedStorage)
+
+		os.Unsetenv("IMPR_CACHE_STORAGE")
+		os.Unsetenv("IMPR_CACHE_SHARED")
+	})
+
+	t.Run("peers without self url", func(t *testing.T) {
+		os.Setenv("IMPR_PEERS", "http://10.0.0.1:8080")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrPeerSelfNotSet)
+
+		os.Unsetenv("IMPR_PEERS")
+	})
+
+	t.Run("peers without secret", func(t *testing.T) {
+		os.Setenv("IMPR_PEERS", "http://10.0.0.1:8080")
+		os.Setenv("IMPR_PEER_SELF", "http://10.0.0.2:8080")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrPeerSecretNotSet)
+
+		os.Unsetenv("IMPR_PEERS")
+		os.Unsetenv("IMPR_PEER_SELF")
+	})
+
+	t.Run("invalid peer url", func(t *testing.T) {
+		os.Setenv("IMPR_PEERS", "10.0.0.1:8080")
+		os.Setenv("IMPR_PEER_SELF", "http://10.0.0.2:8080")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrInvalidPeer)
+
+		os.Unsetenv("IMPR_PEERS")
+		os.Unsetenv("IMPR_PEER_SELF")
+	})
+
+	t.Run("invalid admin port", func(t *testing.T) {
+		os.Setenv("IMPR_ADMIN_PORT", "0")
+
+		_, err := New(logg)
+		require.ErrorIs(t, err, ErrInvalidPort)
+
+		os.Unsetenv("IMPR_ADMIN_PORT")
 	})
 }
@@ -2,56 +2,203 @@ package downloader
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
 )
 
-var ErrInvalidFileType = errors.New("invalid file type")
+// Metrics host label of hosts not listed in options.
+const otherHost = "other"
+
+// Max size of remote server error body kept for relaying.
+const maxErrorBodySize = 64 * 1024
+
+var ErrInvalidFileType = apperror.New(apperror.UnsupportedMedia, "invalid file type")
+
+// Client request headers, that make request conditional or partial. They are
+// not forwarded, downloader and peers fetch whole images and make conditional
+// requests themselves.
+var ConditionalHeaders = []string{
+	"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range",
+}
+
+// Remote server response headers kept for relaying.
+var relayedHeaders = []string{"Content-Type", "WWW-Authenticate", "Proxy-Authenticate", "Retry-After"}
+
+// Remote server error response.
+type ResponseError struct {
+	Status     string
+	StatusCode int
+	Header     http.Header // relayed headers only
+	Body       []byte      // bounded body
+}
+
+func (e *ResponseError) Error() string {
+	return "remote server return: " + e.Status
+}
+
+// Get response to relay.
+func (e *ResponseError) Response() (int, http.Header, []byte) {
+	return e.StatusCode, e.Header, e.Body
+}
+
+// Http client options.
+type Options struct {
+	RequestTimeout        time.Duration // whole request, including body read
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	KeepAlive             time.Duration // tcp keep-alive period
+	IdleConnTimeout       time.Duration // idle connections lifetime
+	MaxIdleConnsPerHost   int
+	HTTP2                 bool
+	Metrics               *metrics.Registry // nil disables instrumentation
+	MetricsHosts          []string          // hosts labeled in metrics, others are labeled "other"
+}
+
+// Remote image validators for conditional requests.
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Downloaded image.
+type Image struct {
+	Data        []byte // empty if image is not modified
+	NotModified bool
+	Validators
+	Expires time.Time // freshness lifetime end, zero if remote server gave no info
+}
 
 type Downloader struct {
-	client *http.Client
+	client   *http.Client
+	duration *metrics.Histogram // by remote host
+	size     *metrics.Histogram // by remote host
+	hosts    map[string]bool    // hosts labeled in metrics
 }
 
 // Create new http client.
-func New(to time.Duration) *Downloader {
-	client := http.Client{Timeout: to}
+func New(opts Options) *Downloader {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
 
-	return &Downloader{&client}
-}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     opts.HTTP2,
+	}
 
-// Get image.
-func (d *Downloader) GetImage(url string, hdr map[string][]string) ([]byte, error) {
-	// Create request context.
-	ctx := context.Background()
+	// Non-nil empty map disables HTTP/2.
+	if !opts.HTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
 
+	client := http.Client{
+		Transport: transport,
+		Timeout:   opts.RequestTimeout,
+	}
+
+	// Hosts come from client requests, so only known hosts get own series.
+	hosts := make(map[string]bool, len(opts.MetricsHosts))
+	for _, h := range opts.MetricsHosts {
+		hosts[strings.ToLower(h)] = true
+	}
+
+	return &Downloader{
+		client: &client,
+		hosts:  hosts,
+		duration: opts.Metrics.Histogram("imgpreviewer_download_duration_seconds",
+			"Original image download duration in seconds.", metrics.DurationBuckets, "host"),
+		size: opts.Metrics.Histogram("imgpreviewer_download_size_bytes",
+			"Downloaded original image size in bytes.", metrics.SizeBuckets, "host"),
+	}
+}
+
+// Get image, conditionally if validators are given.
+func (d *Downloader) GetImage(ctx context.Context, url string, hdr map[string][]string, v Validators) (*Image, error) {
 	// Create request.
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, apperror.Wrap(apperror.BadRequest, err)
 	}
 
+	// Observe download duration, including failed downloads.
+	start := time.Now()
+	defer func() {
+		d.duration.Observe(time.Since(start).Seconds(), d.hostLabel(req.URL.Host))
+	}()
+
 	// Copy request headers.
-	req.Header = hdr
+	req.Header = http.Header(hdr).Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+
+	for _, name := range ConditionalHeaders {
+		req.Header.Del(name)
+	}
+
+	// Set validators.
+	if v.ETag != "" {
+		req.Header.Set("If-None-Match", v.ETag)
+	}
+
+	if v.LastModified != "" {
+		req.Header.Set("If-Modified-Since", v.LastModified)
+	}
 
 	// Send request.
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := d.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 	defer resp.Body.Close()
 
+	img := &Image{
+		Validators: Validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		},
+		Expires: ParseExpires(resp.Header, time.Now()),
+	}
+
+	// Cached image is still valid.
+	if resp.StatusCode == http.StatusNotModified {
+		img.NotModified = true
+
+		return img, nil
+	}
+
 	// Check response status.
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("remote server return: %v", resp.Status)
+		err := NewResponseError(resp)
+
+		// Client errors are mirrored, other errors mean remote server failure.
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, apperror.WrapUpstream(resp.StatusCode, err)
+		}
+
+		return nil, apperror.Wrap(apperror.BadGateway, err)
 	}
 
 	// Get body bytes.
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 
 	// Check if content is jpeg.
@@ -60,5 +207,87 @@ func (d *Downloader) GetImage(url string, hdr map[string][]string) ([]byte, erro
 		return nil, ErrInvalidFileType
 	}
 
-	return body, nil
+	img.Data = body
+	d.size.Observe(float64(len(body)), d.hostLabel(req.URL.Host))
+
+	return img, nil
+}
+
+// Get metrics host label, unknown hosts share one label.
+func (d *Downloader) hostLabel(host string) string {
+	host = strings.ToLower(host)
+	if d.hosts[host] {
+		return host
+	}
+
+	return otherHost
+}
+
+// Get freshness lifetime end from response caching headers, zero if headers
+// give no info.
+func ParseExpires(hdr http.Header, now time.Time) time.Time {
+	for _, directive := range strings.Split(hdr.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		switch {
+		// Must be revalidated every time.
+		case directive == "no-cache" || directive == "no-store":
+			return now
+
+		case strings.HasPrefix(directive, "max-age="):
+			age, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil {
+				return now.Add(time.Duration(age) * time.Second)
+			}
+		}
+	}
+
+	// Fallback to Expires header.
+	if exp := hdr.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			// Invalid date means already expired.
+			return now
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Create remote server error from response, its body is read.
+func NewResponseError(resp *http.Response) *ResponseError {
+	hdr := make(http.Header)
+	for _, name := range relayedHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			hdr[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	// Body is relayed as is, read errors just truncate it.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	return &ResponseError{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     hdr,
+		Body:       body,
+	}
+}
+
+// Set kind of remote server connection error.
+func classify(err error) error {
+	// Client gone, nothing to classify.
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	// Timeouts.
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return apperror.Wrap(apperror.Timeout, err)
+	}
+
+	return apperror.Wrap(apperror.BadGateway, err)
 }
@@ -1,39 +1,235 @@
 package downloader
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
 )
 
 func TestDownloader(t *testing.T) {
-	dl := New(10 * time.Second)
+	dl := New(Options{RequestTimeout: 10 * time.Second})
 	var hdr map[string][]string
+	ctx := context.Background()
 
 	t.Run("download image", func(t *testing.T) {
 		orig, err := os.ReadFile("../../examples/space.jpg")
 		require.NoError(t, err)
 
-		img, err := dl.GetImage(
+		img, err := dl.GetImage(ctx,
 			"https://www.fileformat.info/format/jpeg/sample/0c047d42fdfb419e86c594f0f7ad3ce1/SPACE.JPG",
-			hdr)
+			hdr, Validators{})
 		require.NoError(t, err)
-		require.Equal(t, orig, img)
+		require.Equal(t, orig, img.Data)
 	})
 
 	t.Run("not image", func(t *testing.T) {
-		_, err := dl.GetImage(
+		_, err := dl.GetImage(ctx,
 			"https://raw.githubusercontent.com/OtusGolang/final_project/refs/heads/master/03-image-previewer.md",
-			hdr)
+			hdr, Validators{})
 		require.ErrorIs(t, err, ErrInvalidFileType)
 	})
 
 	t.Run("remote server error", func(t *testing.T) {
-		_, err := dl.GetImage(
+		_, err := dl.GetImage(ctx,
 			"https://raw.githubusercontent.com/OtusGolang/final_project/refs/heads/master/fake.file",
-			hdr)
+			hdr, Validators{})
 		require.EqualError(t, err, "remote server return: 404 Not Found")
 	})
 }
+
+func TestDownloaderTimeouts(t *testing.T) {
+	var hdr map[string][]string
+	ctx := context.Background()
+
+	// Server stalls before response.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("request timeout", func(t *testing.T) {
+		dl := New(Options{RequestTimeout: 100 * time.Millisecond})
+
+		start := time.Now()
+		_, err := dl.GetImage(ctx, srv.URL, hdr, Validators{})
+		require.Error(t, err)
+		require.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("response header timeout", func(t *testing.T) {
+		dl := New(Options{ResponseHeaderTimeout: 100 * time.Millisecond})
+
+		start := time.Now()
+		_, err := dl.GetImage(ctx, srv.URL, hdr, Validators{})
+		require.Error(t, err)
+		require.Less(t, time.Since(start), 2*time.Second)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		dl := New(Options{})
+
+		cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+
+		_, err := dl.GetImage(cctx, srv.URL, hdr, Validators{})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestDownloaderResponseError(t *testing.T) {
+	var hdr map[string][]string
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.Header().Set("X-Internal", "secret")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(strings.Repeat("a", maxErrorBodySize+1)))
+	}))
+	defer srv.Close()
+
+	dl := New(Options{})
+
+	_, err := dl.GetImage(ctx, srv.URL, hdr, Validators{})
+	require.EqualError(t, err, "remote server return: 401 Unauthorized")
+
+	var re *ResponseError
+	require.ErrorAs(t, err, &re)
+
+	code, rh, body := re.Response()
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, `Basic realm="test"`, rh.Get("WWW-Authenticate"))
+	require.Empty(t, rh.Get("X-Internal"))
+	require.Len(t, body, maxErrorBodySize)
+}
+
+func TestDownloaderRevalidation(t *testing.T) {
+	ctx := context.Background()
+
+	orig, err := os.ReadFile("../../examples/gopher_50x50.jpg")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		_, _ = w.Write(orig)
+	}))
+	defer srv.Close()
+
+	dl := New(Options{})
+
+	t.Run("full download", func(t *testing.T) {
+		// Client validators are not sent to remote server.
+		hdr := map[string][]string{"If-None-Match": {`"v1"`}}
+
+		img, err := dl.GetImage(ctx, srv.URL, hdr, Validators{})
+		require.NoError(t, err)
+		require.False(t, img.NotModified)
+		require.Equal(t, orig, img.Data)
+		require.Equal(t, `"v1"`, img.ETag)
+		require.WithinDuration(t, time.Now().Add(time.Minute), img.Expires, 5*time.Second)
+		require.Equal(t, []string{`"v1"`}, hdr["If-None-Match"])
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		img, err := dl.GetImage(ctx, srv.URL, nil, Validators{ETag: `"v1"`})
+		require.NoError(t, err)
+		require.True(t, img.NotModified)
+		require.Empty(t, img.Data)
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		img, err := dl.GetImage(ctx, srv.URL, nil, Validators{ETag: `"v0"`})
+		require.NoError(t, err)
+		require.False(t, img.NotModified)
+		require.Equal(t, orig, img.Data)
+	})
+}
+
+func TestDownloaderMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	orig, err := os.ReadFile("../../examples/gopher_50x50.jpg")
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(orig)
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	t.Run("known host", func(t *testing.T) {
+		reg := metrics.NewRegistry()
+		dl := New(Options{Metrics: reg, MetricsHosts: []string{host}})
+
+		_, err = dl.GetImage(ctx, srv.URL, nil, Validators{})
+		require.NoError(t, err)
+
+		out := &strings.Builder{}
+		_, err = reg.WriteTo(out)
+		require.NoError(t, err)
+		require.Contains(t, out.String(), `imgpreviewer_download_duration_seconds_count{host="`+host+`"} 1`+"\n")
+		require.Contains(t, out.String(), `imgpreviewer_download_size_bytes_sum{host="`+host+`"} `+strconv.Itoa(len(orig))+"\n")
+	})
+
+	t.Run("unknown hosts share label", func(t *testing.T) {
+		reg := metrics.NewRegistry()
+		dl := New(Options{Metrics: reg})
+
+		_, err = dl.GetImage(ctx, srv.URL, nil, Validators{})
+		require.NoError(t, err)
+		_, err = dl.GetImage(ctx, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), nil, Validators{})
+		require.NoError(t, err)
+
+		out := &strings.Builder{}
+		_, err = reg.WriteTo(out)
+		require.NoError(t, err)
+		require.Contains(t, out.String(), `imgpreviewer_download_duration_seconds_count{host="other"} 2`+"\n")
+		require.NotContains(t, out.String(), host)
+	})
+}
+
+func TestParseExpires(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		hdr     http.Header
+		expires time.Time
+	}{
+		{"no headers", http.Header{}, time.Time{}},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=100"}}, now.Add(100 * time.Second)},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, now},
+		{"expires", http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, now.Add(time.Hour).Truncate(time.Second)},
+		{"invalid expires", http.Header{"Expires": {"0"}}, now},
+		{
+			"max-age overrides expires",
+			http.Header{"Cache-Control": {"max-age=10"}, "Expires": {now.UTC().Format(http.TimeFormat)}},
+			now.Add(10 * time.Second),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.True(t, tc.expires.Equal(ParseExpires(tc.hdr, now)))
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Default latency buckets in seconds.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default size buckets in bytes, from 1KB to 64MB.
+var SizeBuckets = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26}
+
+// Registry of metrics, exposed in Prometheus text format. It wraps Prometheus
+// client registry, so instrumented packages don't depend on it, and nil
+// registry disables instrumentation.
+type Registry struct {
+	reg *prometheus.Registry
+}
+
+// Monotonic counter.
+type Counter struct {
+	vec *prometheus.CounterVec
+}
+
+// Gauge, that can go up and down.
+type Gauge struct {
+	vec *prometheus.GaugeVec
+}
+
+// Histogram of observed values.
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		reg: prometheus.NewRegistry(),
+	}
+}
+
+// Get counter, registering it if needed. Nil registry returns no-op counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	if r == nil {
+		return nil
+	}
+
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+
+	return &Counter{register(r.reg, vec)}
+}
+
+// Get gauge, registering it if needed. Nil registry returns no-op gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	if r == nil {
+		return nil
+	}
+
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+
+	return &Gauge{register(r.reg, vec)}
+}
+
+// Get histogram, registering it if needed. Nil registry returns no-op histogram.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if r == nil {
+		return nil
+	}
+
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+
+	return &Histogram{register(r.reg, vec)}
+}
+
+// Register collector, existing collector with the same description is reused.
+// Collector with the same name, but different type or labels, panics.
+func register[T prometheus.Collector](reg *prometheus.Registry, c T) T {
+	err := reg.Register(c)
+	if err == nil {
+		return c
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+
+	panic(err)
+}
+
+// Increment counter by one.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add non-negative value to counter.
+func (c *Counter) Add(v float64, labels ...string) {
+	if c == nil || v < 0 {
+		return
+	}
+
+	c.vec.WithLabelValues(labels...).Add(v)
+}
+
+// Set gauge value.
+func (g *Gauge) Set(v float64, labels ...string) {
+	if g == nil {
+		return
+	}
+
+	g.vec.WithLabelValues(labels...).Set(v)
+}
+
+// Observe value.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	if h == nil {
+		return
+	}
+
+	h.vec.WithLabelValues(labels...).Observe(v)
+}
+
+// Write metrics in Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	families, err := r.reg.Gather()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, f := range families {
+		written, err := expfmt.MetricFamilyToText(w, f)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Get http handler, that exposes metrics.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("counter", func(t *testing.T) {
+		r := NewRegistry()
+
+		c := r.Counter("test_total", "Test counter.", "cache")
+		c.Inc("previews")
+		c.Add(2, "previews")
+		c.Add(-1, "previews")
+		r.Counter("test_total", "Test counter.", "cache").Inc("sources")
+
+		out := &strings.Builder{}
+		_, err := r.WriteTo(out)
+		require.NoError(t, err)
+		require.Equal(t, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{cache="previews"} 3
+test_total{cache="sources"} 1
+`, out.String())
+	})
+
+	t.Run("gauge", func(t *testing.T) {
+		r := NewRegistry()
+
+		g := r.Gauge("test_bytes", "Test gauge.")
+		g.Set(10)
+		g.Set(5)
+
+		out := &strings.Builder{}
+		_, err := r.WriteTo(out)
+		require.NoError(t, err)
+		require.Equal(t, `# HELP test_bytes Test gauge.
+# TYPE test_bytes gauge
+test_bytes 5
+`, out.String())
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		r := NewRegistry()
+
+		h := r.Histogram("test_seconds", "Test histogram.", []float64{0.1, 1}, "host")
+		h.Observe(0.05, `a"b`)
+		h.Observe(0.5, `a"b`)
+		h.Observe(5, `a"b`)
+
+		out := &strings.Builder{}
+		_, err := r.WriteTo(out)
+		require.NoError(t, err)
+		require.Equal(t, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{host="a\"b",le="0.1"} 1
+test_seconds_bucket{host="a\"b",le="1"} 2
+test_seconds_bucket{host="a\"b",le="+Inf"} 3
+test_seconds_sum{host="a\"b"} 5.55
+test_seconds_count{host="a\"b"} 3
+`, out.String())
+	})
+
+	t.Run("nil registry", func(t *testing.T) {
+		var r *Registry
+
+		require.NotPanics(t, func() {
+			r.Counter("test_total", "Test counter.").Inc()
+			r.Gauge("test_bytes", "Test gauge.").Set(1)
+			r.Histogram("test_seconds", "Test histogram.", DurationBuckets).Observe(1)
+		})
+	})
+
+	t.Run("labels mismatch", func(t *testing.T) {
+		r := NewRegistry()
+
+		require.Panics(t, func() {
+			r.Counter("test_total", "Test counter.", "cache").Inc()
+		})
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		r := NewRegistry()
+		r.Counter("test_total", "Test counter.").Inc()
+
+		w := httptest.NewRecorder()
+		r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+		require.Contains(t, w.Body.String(), "test_total 1\n")
+	})
+}
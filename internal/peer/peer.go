@@ -0,0 +1,290 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/downloader"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+)
+
+// Request header with peer secret, that marks request from other replica.
+// Such request is processed locally, so misconfigured replicas do not forward
+// it in loop.
+const Header = "X-Impr-Peer"
+
+// Path of replica purge API, its routes mirror admin API cache routes.
+const PurgePath = "/peer/cache"
+
+// Number of ring points per replica.
+const defaultReplicas = 64
+
+// Max size of owner replica error body kept for message.
+const maxErrorMessageSize = 1024
+
+var ErrUnavailable = errors.New("owner replica is unavailable")
+
+// Peer pool options.
+type Options struct {
+	Timeout  time.Duration     // owner replica request timeout
+	Secret   string            // shared secret of replicas
+	Replicas int               // ring points per replica, default 64
+	Client   *http.Client      // optional http client
+	Metrics  *metrics.Registry // nil disables instrumentation
+}
+
+// Pool of replicas sharing previews. Each preview is rendered and cached by
+// its owner replica only, others fetch it from owner. Nil pool owns all keys.
+type Pool struct {
+	self     string
+	secret   string
+	peers    []string // other replicas
+	ring     *Ring
+	client   *http.Client
+	timeout  time.Duration
+	requests *metrics.Counter // by result
+}
+
+// Create pool of replicas base urls, self is this replica url.
+func NewPool(self string, peers []string, opts Options) *Pool {
+	if opts.Replicas <= 0 {
+		opts.Replicas = defaultReplicas
+	}
+
+	if opts.Client == nil {
+		opts.Client = &http.Client{}
+	}
+
+	self = strings.TrimSuffix(self, "/")
+
+	nodes := make([]string, 0, len(peers)+1)
+	for _, p := range slices.Concat(peers, []string{self}) {
+		nodes = append(nodes, strings.TrimSuffix(p, "/"))
+	}
+
+	return &Pool{
+		self:    self,
+		secret:  opts.Secret,
+		peers:   slices.DeleteFunc(slices.Clone(nodes), func(n string) bool { return n == self }),
+		ring:    NewRing(opts.Replicas, nodes...),
+		client:  opts.Client,
+		timeout: opts.Timeout,
+		requests: opts.Metrics.Counter("imgpreviewer_peer_requests_total",
+			"Number of preview requests to owner replicas by result.", "result"),
+	}
+}
+
+// Get owner replica of key, returns false if key is owned by this replica.
+func (p *Pool) Owner(key string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	owner := p.ring.Get(key)
+
+	return owner, owner != p.self
+}
+
+// Check if request is from other replica, and get request headers without peer
+// header, so secret is not forwarded to remote servers. Nil pool or pool without
+// secret trusts no requests.
+func (p *Pool) Trusted(hdr map[string][]string) (map[string][]string, bool) {
+	value := http.Header(hdr).Get(Header)
+	if value == "" {
+		return hdr, false
+	}
+
+	stripped := http.Header(hdr).Clone()
+	stripped.Del(Header)
+
+	trusted := p != nil && p.secret != "" && subtle.ConstantTimeCompare([]byte(value), []byte(p.secret)) == 1
+
+	return stripped, trusted
+}
+
+// Get preview at given unescaped path from owner replica. Returns ErrUnavailable, if
+// owner replica can't be reached or fails, so preview may be rendered locally.
+func (p *Pool) Fetch(ctx context.Context, owner, path string, hdr map[string][]string) ([]byte, cache.Meta, error) {
+	data, meta, err := p.fetch(ctx, owner, path, hdr)
+
+	switch {
+	case err == nil:
+		p.requests.Inc("ok")
+	case errors.Is(err, ErrUnavailable):
+		p.requests.Inc("unavailable")
+	default:
+		p.requests.Inc("error")
+	}
+
+	return data, meta, err
+}
+
+func (p *Pool) fetch(ctx context.Context, owner, path string, hdr map[string][]string) ([]byte, cache.Meta, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	u, err := url.Parse(owner)
+	if err != nil {
+		return nil, cache.Meta{}, apperror.Wrap(apperror.Internal, err)
+	}
+	u.Path += path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, cache.Meta{}, apperror.Wrap(apperror.Internal, err)
+	}
+
+	req.Header = http.Header(hdr).Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	// Owner replica must return whole preview.
+	for _, name := range downloader.ConditionalHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set(Header, p.secret)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// Client has gone, nothing to render.
+		if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+			return nil, cache.Meta{}, err
+		}
+
+		return nil, cache.Meta{}, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, cache.Meta{}, responseError(owner, resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, cache.Meta{}, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	meta := cache.Meta{
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+		Expires:     downloader.ParseExpires(resp.Header, time.Now()),
+	}
+
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		meta.ModTime = lm
+	}
+
+	return data, meta, nil
+}
+
+// Purge cached files on other replicas, query is admin API purge query, nil
+// query flushes whole cache. Returns errors of replicas, that failed to purge.
+func (p *Pool) Purge(ctx context.Context, query url.Values) error {
+	if p == nil {
+		return nil
+	}
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	errs := make([]error, len(p.peers))
+
+	var wg sync.WaitGroup
+	for i, replica := range p.peers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			errs[i] = p.purge(ctx, replica, query)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (p *Pool) purge(ctx context.Context, replica string, query url.Values) error {
+	u, err := url.Parse(replica)
+	if err != nil {
+		return err
+	}
+
+	if query == nil {
+		u.Path += PurgePath
+	} else {
+		u.Path += PurgePath + "/entries"
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(Header, p.secret)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to purge replica %s: %w", replica, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to purge replica %s: %s", replica, resp.Status)
+	}
+
+	return nil
+}
+
+// Owner replica error response, that can be relayed to client as is.
+type ownerError struct {
+	*downloader.ResponseError
+	msg string
+}
+
+func (e *ownerError) Error() string {
+	return e.msg
+}
+
+// Get error of failed owner replica response. Client errors are returned with
+// owner replica status code and response to relay, service failures are
+// ErrUnavailable.
+func responseError(owner string, resp *http.Response) error {
+	re := downloader.NewResponseError(resp)
+
+	// Error message of owner replica.
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(re.Body, &e) != nil || e.Error == "" {
+		e.Error = string(bytes.TrimSpace(re.Body[:min(len(re.Body), maxErrorMessageSize)]))
+	}
+
+	msg := fmt.Sprintf("owner replica %s return: %s: %s", owner, resp.Status, e.Error)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: %s", ErrUnavailable, msg)
+	}
+
+	return apperror.WrapUpstream(resp.StatusCode, &ownerError{re, msg})
+}
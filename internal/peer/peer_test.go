@@ -0,0 +1,156 @@
+package peer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+)
+
+const testSecret = "secret"
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fill/100/100/example.com/image 1.jpg":
+			// Whole preview is requested on behalf of replica.
+			if r.Header.Get(Header) != testSecret || r.Header.Get("If-None-Match") != "" || r.Header.Get("Range") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			_, _ = w.Write([]byte("preview"))
+		case "/fill/5000/5000/example.com/image.jpg":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"status":422,"error":"target size is larger than original"}`))
+		case "/fill/100/100/example.com/private.jpg":
+			w.Header().Set("WWW-Authenticate", `Basic realm="images"`)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("unauthorized"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer owner.Close()
+
+	p := NewPool("http://self:8080", []string{owner.URL}, Options{Timeout: time.Second, Secret: testSecret})
+
+	t.Run("owner of key", func(t *testing.T) {
+		remote, local := 0, 0
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+			o, isRemote := p.Owner(key)
+			if isRemote {
+				require.Equal(t, owner.URL, o)
+				remote++
+			} else {
+				require.Equal(t, "http://self:8080", o)
+				local++
+			}
+		}
+
+		require.NotZero(t, remote)
+		require.NotZero(t, local)
+	})
+
+	t.Run("nil pool owns all keys", func(t *testing.T) {
+		var p *Pool
+
+		_, remote := p.Owner("a")
+		require.False(t, remote)
+	})
+
+	t.Run("trusted requests", func(t *testing.T) {
+		hdr := map[string][]string{Header: {testSecret}, "Accept": {"image/*"}}
+
+		stripped, trusted := p.Trusted(hdr)
+		require.True(t, trusted)
+		require.Equal(t, map[string][]string{"Accept": {"image/*"}}, stripped)
+
+		// Client headers are not modified.
+		require.Len(t, hdr, 2)
+
+		// Peer header is removed from untrusted requests too.
+		stripped, trusted = p.Trusted(map[string][]string{Header: {"wrong"}})
+		require.False(t, trusted)
+		require.Empty(t, stripped)
+
+		_, trusted = p.Trusted(map[string][]string{"Accept": {"image/*"}})
+		require.False(t, trusted)
+
+		// Pool without secret trusts no requests.
+		_, trusted = NewPool("http://self:8080", nil, Options{}).Trusted(map[string][]string{Header: {testSecret}})
+		require.False(t, trusted)
+
+		var nilPool *Pool
+		stripped, trusted = nilPool.Trusted(map[string][]string{Header: {testSecret}})
+		require.False(t, trusted)
+		require.Empty(t, stripped)
+	})
+
+	t.Run("fetch preview", func(t *testing.T) {
+		hdr := map[string][]string{"If-None-Match": {`"abc"`}, "Range": {"bytes=0-1"}}
+
+		data, meta, err := p.Fetch(ctx, owner.URL, "/fill/100/100/example.com/image 1.jpg", hdr)
+		require.NoError(t, err)
+		require.Equal(t, []byte("preview"), data)
+		require.Equal(t, "image/jpeg", meta.ContentType)
+		require.Equal(t, `"abc"`, meta.ETag)
+		require.True(t, modTime.Equal(meta.ModTime))
+
+		// Preview is not fresh longer than on owner replica.
+		require.WithinDuration(t, time.Now().Add(time.Minute), meta.Expires, 5*time.Second)
+
+		// Client headers are not modified.
+		require.Len(t, hdr, 2)
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		_, _, err := p.Fetch(ctx, owner.URL, "/fill/5000/5000/example.com/image.jpg", nil)
+		require.NotErrorIs(t, err, ErrUnavailable)
+		require.Equal(t, http.StatusUnprocessableEntity, apperror.StatusCode(err))
+		require.Contains(t, err.Error(), "target size is larger than original")
+	})
+
+	t.Run("relayed client error", func(t *testing.T) {
+		_, _, err := p.Fetch(ctx, owner.URL, "/fill/100/100/example.com/private.jpg", nil)
+		require.Equal(t, http.StatusUnauthorized, apperror.StatusCode(err))
+		require.Contains(t, err.Error(), "unauthorized")
+
+		// Owner replica response is kept to relay.
+		var re interface {
+			Response() (int, http.Header, []byte)
+		}
+		require.ErrorAs(t, err, &re)
+
+		code, hdr, body := re.Response()
+		require.Equal(t, http.StatusUnauthorized, code)
+		require.Equal(t, `Basic realm="images"`, hdr.Get("WWW-Authenticate"))
+		require.Equal(t, []byte("unauthorized"), body)
+	})
+
+	t.Run("owner failure", func(t *testing.T) {
+		_, _, err := p.Fetch(ctx, owner.URL, "/fill/100/100/example.com/other.jpg", nil)
+		require.ErrorIs(t, err, ErrUnavailable)
+	})
+
+	t.Run("owner is down", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+
+		_, _, err := p.Fetch(ctx, down.URL, "/fill/100/100/example.com/image.jpg", nil)
+		require.ErrorIs(t, err, ErrUnavailable)
+	})
+}
@@ -0,0 +1,57 @@
+package peer
+
+import (
+	"hash/crc32"
+	"slices"
+	"strconv"
+)
+
+// Consistent hash ring of replicas. Each replica gets several points on the
+// ring, so keys are spread evenly and move to other replicas only when their
+// owner leaves.
+type Ring struct {
+	points []uint32
+	nodes  map[uint32]string
+}
+
+// Create ring with given number of points per node.
+func NewRing(replicas int, nodes ...string) *Ring {
+	r := &Ring{
+		nodes: make(map[uint32]string, len(nodes)*replicas),
+	}
+
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+
+			// Colliding point keeps its first node.
+			if _, exists := r.nodes[point]; exists {
+				continue
+			}
+
+			r.nodes[point] = node
+			r.points = append(r.points, point)
+		}
+	}
+
+	slices.Sort(r.points)
+
+	return r
+}
+
+// Get node owning key, empty ring returns empty string.
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+
+	// First point clockwise from key hash.
+	i, _ := slices.BinarySearch(r.points, hash)
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.nodes[r.points[i]]
+}
@@ -0,0 +1,52 @@
+package peer
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+
+	t.Run("empty ring", func(t *testing.T) {
+		require.Empty(t, NewRing(defaultReplicas).Get("key"))
+	})
+
+	t.Run("same owner on all replicas", func(t *testing.T) {
+		r1 := NewRing(defaultReplicas, nodes...)
+		r2 := NewRing(defaultReplicas, nodes[2], nodes[0], nodes[1])
+
+		for i := 0; i < 1000; i++ {
+			key := "100-100-http://example.com/" + strconv.Itoa(i)
+			require.Equal(t, r1.Get(key), r2.Get(key))
+		}
+	})
+
+	t.Run("keys are spread", func(t *testing.T) {
+		r := NewRing(defaultReplicas, nodes...)
+
+		owners := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			owners[r.Get("100-100-http://example.com/"+strconv.Itoa(i))]++
+		}
+
+		require.Len(t, owners, len(nodes))
+		for _, n := range owners {
+			require.Greater(t, n, 500)
+		}
+	})
+
+	t.Run("only keys of removed node move", func(t *testing.T) {
+		r := NewRing(defaultReplicas, nodes...)
+		shrunk := NewRing(defaultReplicas, nodes[:2]...)
+
+		for i := 0; i < 1000; i++ {
+			key := "100-100-http://example.com/" + strconv.Itoa(i)
+			if owner := r.Get(key); owner != nodes[2] {
+				require.Equal(t, owner, shrunk.Get(key))
+			}
+		}
+	})
+}
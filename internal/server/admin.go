@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yakuninmax/imgpreviewer/internal/app"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+	"github.com/yakuninmax/imgpreviewer/internal/peer"
+)
+
+// Warm-up limits.
+const (
+	maxWarmListSize        = 10 << 20
+	defaultWarmConcurrency = 4
+	maxWarmConcurrency     = 64
+	maxWarmJobs            = 16 // finished jobs are kept until limit is reached
+	maxRunningWarmJobs     = 4  // new jobs are rejected until running ones finish
+)
+
+// Warm job statuses.
+const (
+	warmRunning = "running"
+	warmDone    = "done"
+)
+
+// Purge query parameters.
+var purgeParams = []string{"key", "url", "prefix", "host"}
+
+var errWarmJobsLimit = errors.New("too many running warm jobs")
+
+type purger interface {
+	PurgeKey(key string) (int, error)
+	PurgeURL(url string) (int, error)
+	PurgePrefix(prefix string) (int, error)
+	PurgeHost(host string) (int, error)
+	Flush() (int, error)
+}
+
+type cacheAdmin interface {
+	purger
+	Entries() ([]cache.Entry, []cache.Entry)
+	Warm(ctx context.Context, targets []app.WarmTarget, concurrency int) app.WarmReport
+}
+
+// Cache entries list response body.
+type entriesResponse struct {
+	Previews []cache.Entry `json:"previews"`
+	Sources  []cache.Entry `json:"sources"`
+}
+
+// Purge response body.
+type purgeResponse struct {
+	Removed int    `json:"removed"`
+	Error   string `json:"error,omitempty"` // replicas purge failure
+}
+
+// Warm-up job, previews are rendered in background.
+type warmJob struct {
+	ID      string          `json:"id"`
+	Status  string          `json:"status"`
+	Started time.Time       `json:"started"`
+	Report  *app.WarmReport `json:"report,omitempty"` // set when done
+}
+
+// Admin API server, listens on separate port.
+type Admin struct {
+	addr    string
+	token   string
+	app     cacheAdmin
+	peers   *peer.Pool // replicas, that purges are sent to
+	logger  logger
+	metrics *metrics.Registry // exposed on /metrics, if not nil
+	server  *http.Server
+	ctx     context.Context // canceled on stop, so warm jobs are stopped
+	cancel  context.CancelFunc
+	jobsMu  sync.Mutex
+	jobs    []*warmJob // oldest first
+}
+
+func NewAdmin(port, token string, app cacheAdmin, peers *peer.Pool, logg logger, reg *metrics.Registry) *Admin {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Admin{
+		ctx:     ctx,
+		cancel:  cancel,
+		addr:    ":" + port,
+		token:   token,
+		app:     app,
+		peers:   peers,
+		logger:  logg,
+		metrics: reg,
+	}
+}
+
+func (s *Admin) Start() error {
+	// Configure server.
+	s.server = &http.Server{
+		Addr:         s.addr,
+		Handler:      s.handler(),
+		WriteTimeout: writeTimeout,
+		ReadTimeout:  readTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+
+	// Run server.
+	err := s.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("failed to start admin http server: %w", err)
+	}
+
+	return nil
+}
+
+// Get admin API router, all requests are authenticated.
+func (s *Admin) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /cache/entries", s.entriesHandler)
+	mux.HandleFunc("DELETE /cache/entries", s.purgeHandler)
+	mux.HandleFunc("DELETE /cache", s.flushHandler)
+	mux.HandleFunc("POST /cache/warm", s.warmHandler)
+	mux.HandleFunc("GET /cache/warm/{id}", s.warmJobHandler)
+
+	if s.metrics != nil {
+		mux.Handle("GET /metrics", s.metrics.Handler())
+	}
+
+	return s.authenticate(mux)
+}
+
+func (s *Admin) Stop(ctx context.Context) error {
+	s.cancel()
+
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("admin server shutdown failed: %w", err)
+	}
+
+	return nil
+}
+
+// Check request bearer token.
+func (s *Admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			s.logger.Warn("unauthorized admin request " + r.Method + " " + r.URL.String() + " from " + r.RemoteAddr)
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			s.writeJSON(w, http.StatusUnauthorized, errorResponse{
+				Status: http.StatusUnauthorized,
+				Error:  http.StatusText(http.StatusUnauthorized),
+			})
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// List cache entries handler.
+func (s *Admin) entriesHandler(w http.ResponseWriter, _ *http.Request) {
+	previews, sources := s.app.Entries()
+
+	s.writeJSON(w, http.StatusOK, entriesResponse{previews, sources})
+}
+
+// Purge cache entries handler, purge is sent to other replicas too.
+func (s *Admin) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	name, value, err := parsePurge(r.URL.Query())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	removed, err := runPurge(s.app, name, value)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.logger.Info("purged " + strconv.Itoa(removed) + " cache files by " + name + " " + value)
+
+	s.writeJSON(w, http.StatusOK, s.purgePeers(r.Context(), removed, url.Values{name: {value}}))
+}
+
+// Flush cache handler, other replicas are flushed too.
+func (s *Admin) flushHandler(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.app.Flush()
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.logger.Info("flushed " + strconv.Itoa(removed) + " cache files")
+
+	s.writeJSON(w, http.StatusOK, s.purgePeers(r.Context(), removed, nil))
+}
+
+// Send purge to other replicas, they may keep previews rendered by them.
+// Returns purge response with replicas failure.
+func (s *Admin) purgePeers(ctx context.Context, removed int, query url.Values) purgeResponse {
+	resp := purgeResponse{Removed: removed}
+
+	err := s.peers.Purge(ctx, query)
+	if err != nil {
+		s.logger.Error(err.Error())
+		resp.Error = err.Error()
+	}
+
+	return resp
+}
+
+// Get purge parameter name and value, exactly one of key, url, prefix or host
+// must be given.
+func parsePurge(query url.Values) (string, string, error) {
+	var name, value string
+
+	for _, n := range purgeParams {
+		if v := query.Get(n); v != "" {
+			if name != "" {
+				return "", "", apperror.New(apperror.BadRequest, "only one of key, url, prefix or host allowed")
+			}
+
+			name, value = n, v
+		}
+	}
+
+	if name == "" {
+		return "", "", apperror.New(apperror.BadRequest, "one of key, url, prefix or host required")
+	}
+
+	return name, value, nil
+}
+
+// Purge by parameter name, returns number of removed files.
+func runPurge(p purger, name, value string) (int, error) {
+	switch name {
+	case "key":
+		return p.PurgeKey(value)
+	case "url":
+		return p.PurgeURL(value)
+	case "prefix":
+		return p.PurgePrefix(value)
+	default:
+		return p.PurgeHost(value)
+	}
+}
+
+// Warm cache handler. Request body is warm list, previews are rendered in
+// background with concurrency query parameter, default 4. Returns warm job,
+// its status is available at Location.
+func (s *Admin) warmHandler(w http.ResponseWriter, r *http.Request) {
+	concurrency := defaultWarmConcurrency
+	if v := r.URL.Query().Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxWarmConcurrency {
+			s.writeError(w, apperror.New(apperror.BadRequest,
+				"concurrency must be integer from 1 to "+strconv.Itoa(maxWarmConcurrency)))
+			return
+		}
+
+		concurrency = n
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmListSize))
+	if err != nil {
+		s.writeError(w, apperror.Wrap(apperror.BadRequest, fmt.Errorf("failed to read warm list: %w", err)))
+		return
+	}
+
+	targets, err := app.ParseWarmList(data)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	job, err := s.startWarm(targets, concurrency)
+	switch {
+	// Client should retry, when running jobs finish.
+	case errors.Is(err, errWarmJobsLimit):
+		s.logger.Warn(err.Error())
+		s.writeJSON(w, http.StatusTooManyRequests, errorResponse{
+			Status: http.StatusTooManyRequests,
+			Error:  err.Error(),
+		})
+
+		return
+	case err != nil:
+		s.writeError(w, apperror.Wrap(apperror.Internal, err))
+		return
+	}
+
+	w.Header().Set("Location", "/cache/warm/"+job.ID)
+	s.writeJSON(w, http.StatusAccepted, job)
+}
+
+// Warm job status handler.
+func (s *Admin) warmJobHandler(w http.ResponseWriter, r *http.Request) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.ID == r.PathValue("id") {
+			s.writeJSON(w, http.StatusOK, job)
+			return
+		}
+	}
+
+	s.writeJSON(w, http.StatusNotFound, errorResponse{
+		Status: http.StatusNotFound,
+		Error:  "warm job not found",
+	})
+}
+
+// Start warm job, oldest finished jobs are forgotten. Returns job copy, or
+// errWarmJobsLimit if too many jobs are running.
+func (s *Admin) startWarm(targets []app.WarmTarget, concurrency int) (warmJob, error) {
+	id := make([]byte, 8)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		return warmJob{}, fmt.Errorf("failed to create warm job id: %w", err)
+	}
+
+	job := &warmJob{
+		ID:      hex.EncodeToString(id),
+		Status:  warmRunning,
+		Started: time.Now(),
+	}
+
+	s.jobsMu.Lock()
+
+	running := 0
+	for _, j := range s.jobs {
+		if j.Status == warmRunning {
+			running++
+		}
+	}
+
+	if running >= maxRunningWarmJobs {
+		s.jobsMu.Unlock()
+		return warmJob{}, errWarmJobsLimit
+	}
+
+	s.jobs = append(s.jobs, job)
+
+	for i := 0; i < len(s.jobs) && len(s.jobs) > maxWarmJobs; {
+		if s.jobs[i].Status == warmDone {
+			s.jobs = slices.Delete(s.jobs, i, i+1)
+		} else {
+			i++
+		}
+	}
+
+	started := *job
+	s.jobsMu.Unlock()
+
+	s.logger.Info("warming " + strconv.Itoa(len(targets)) + " previews, job " + job.ID)
+
+	go func() {
+		report := s.app.Warm(s.ctx, targets, concurrency)
+
+		s.jobsMu.Lock()
+		defer s.jobsMu.Unlock()
+
+		job.Status = warmDone
+		job.Report = &report
+	}()
+
+	return started, nil
+}
+
+// Write error response.
+func (s *Admin) writeError(w http.ResponseWriter, err error) {
+	code := apperror.StatusCode(err)
+
+	if code >= http.StatusInternalServerError {
+		s.logger.Error(err.Error())
+	} else {
+		s.logger.Warn(err.Error())
+	}
+
+	s.writeJSON(w, code, errorResponse{Status: code, Error: err.Error()})
+}
+
+// Write json response.
+func (s *Admin) writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		s.logger.Error(err.Error())
+	}
+}
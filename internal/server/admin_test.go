@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/app"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+	"github.com/yakuninmax/imgpreviewer/internal/peer"
+)
+
+const testToken = "secret"
+
+// Cache admin, that records purges.
+type fakeAdmin struct {
+	mu      sync.Mutex
+	purged  []string // purge kind and value
+	removed int
+	err     error
+	warm    chan struct{} // blocks warm until closed, if set
+}
+
+func (a *fakeAdmin) Entries() ([]cache.Entry, []cache.Entry) {
+	return []cache.Entry{{Key: "100-50-http://example.com/a.jpg"}}, []cache.Entry{{Key: "http://example.com/a.jpg"}}
+}
+
+func (a *fakeAdmin) PurgeKey(key string) (int, error) {
+	return a.purge("key " + key)
+}
+
+func (a *fakeAdmin) PurgeURL(url string) (int, error) {
+	return a.purge("url " + url)
+}
+
+func (a *fakeAdmin) PurgePrefix(prefix string) (int, error) {
+	return a.purge("prefix " + prefix)
+}
+
+func (a *fakeAdmin) PurgeHost(host string) (int, error) {
+	return a.purge("host " + host)
+}
+
+func (a *fakeAdmin) Flush() (int, error) {
+	return a.purge("flush")
+}
+
+func (a *fakeAdmin) Warm(ctx context.Context, targets []app.WarmTarget, _ int) app.WarmReport {
+	if a.warm != nil {
+		select {
+		case <-a.warm:
+		case <-ctx.Done():
+		}
+	}
+
+	return app.WarmReport{Total: len(targets), Succeeded: len(targets)}
+}
+
+func (a *fakeAdmin) purge(what string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.purged = append(a.purged, what)
+
+	return a.removed, a.err
+}
+
+// Send admin request with given authorization header.
+func serveAdmin(a *Admin, method, target, auth string) *httptest.ResponseRecorder {
+	return serveAdminBody(a, method, target, auth, "")
+}
+
+// Send admin request with body.
+func serveAdminBody(a *Admin, method, target, auth, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+
+	w := httptest.NewRecorder()
+	a.handler().ServeHTTP(w, r)
+
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	reg := metrics.NewRegistry()
+	reg.Counter("test_total", "Test counter.").Inc()
+
+	fa := &fakeAdmin{}
+	a := NewAdmin("0", testToken, fa, nil, nopLogger{}, reg)
+
+	for _, target := range []string{"/cache/entries", "/metrics"} {
+		for name, auth := range map[string]string{
+			"missing token": "",
+			"wrong token":   "Bearer wrong",
+			"basic auth":    "Basic " + testToken,
+			"empty bearer":  "Bearer ",
+		} {
+			t.Run(target+" "+name, func(t *testing.T) {
+				w := serveAdmin(a, http.MethodGet, target, auth)
+
+				require.Equal(t, http.StatusUnauthorized, w.Code)
+				require.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			})
+		}
+
+		t.Run(target+" valid token", func(t *testing.T) {
+			w := serveAdmin(a, http.MethodGet, target, "Bearer "+testToken)
+
+			require.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+
+	t.Run("unset token", func(t *testing.T) {
+		a := NewAdmin("0", "", fa, nil, nopLogger{}, nil)
+
+		w := serveAdmin(a, http.MethodGet, "/cache/entries", "Bearer ")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	// Unauthorized requests purge nothing.
+	w := serveAdmin(a, http.MethodDelete, "/cache", "Bearer wrong")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Empty(t, fa.purged)
+}
+
+func TestAdminPurge(t *testing.T) {
+	auth := "Bearer " + testToken
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		purged string
+	}{
+		{"key", http.MethodDelete, "/cache/entries?key=100-50-example.com/a.jpg", "key 100-50-example.com/a.jpg"},
+		{"url", http.MethodDelete, "/cache/entries?url=example.com/a.jpg", "url example.com/a.jpg"},
+		{"prefix", http.MethodDelete, "/cache/entries?prefix=example.com/img/", "prefix example.com/img/"},
+		{"host", http.MethodDelete, "/cache/entries?host=example.com", "host example.com"},
+		{"flush", http.MethodDelete, "/cache", "flush"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fa := &fakeAdmin{removed: 3}
+			w := serveAdmin(NewAdmin("0", testToken, fa, nil, nopLogger{}, nil), tc.method, tc.target, auth)
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			require.Equal(t, []string{tc.purged}, fa.purged)
+
+			var resp purgeResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Equal(t, 3, resp.Removed)
+		})
+	}
+
+	t.Run("no parameter", func(t *testing.T) {
+		fa := &fakeAdmin{}
+		w := serveAdmin(NewAdmin("0", testToken, fa, nil, nopLogger{}, nil), http.MethodDelete, "/cache/entries", auth)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Empty(t, fa.purged)
+	})
+
+	t.Run("several parameters", func(t *testing.T) {
+		fa := &fakeAdmin{}
+		w := serveAdmin(NewAdmin("0", testToken, fa, nil, nopLogger{}, nil),
+			http.MethodDelete, "/cache/entries?url=example.com/a.jpg&host=example.com", auth)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Empty(t, fa.purged)
+	})
+
+	t.Run("purge failure", func(t *testing.T) {
+		fa := &fakeAdmin{err: apperror.Wrap(apperror.Internal, errors.New("storage failure"))}
+		w := serveAdmin(NewAdmin("0", testToken, fa, nil, nopLogger{}, nil),
+			http.MethodDelete, "/cache/entries?host=example.com", auth)
+
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+
+		var resp errorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, http.StatusInternalServerError, resp.Status)
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		w := serveAdmin(NewAdmin("0", testToken, &fakeAdmin{}, nil, nopLogger{}, nil),
+			http.MethodGet, "/cache/entries", auth)
+
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp entriesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Previews, 1)
+		require.Len(t, resp.Sources, 1)
+	})
+}
+
+func TestAdminWarm(t *testing.T) {
+	auth := "Bearer " + testToken
+	a := NewAdmin("0", testToken, &fakeAdmin{}, nil, nopLogger{}, nil)
+
+	w := serveAdminBody(a, http.MethodPost, "/cache/warm?concurrency=2", auth,
+		"100/50/example.com/a.jpg\n/fill/200/100/example.com/b.jpg\n")
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	var job warmJob
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	require.NotEmpty(t, job.ID)
+	require.Equal(t, warmRunning, job.Status)
+	require.Equal(t, "/cache/warm/"+job.ID, w.Header().Get("Location"))
+
+	require.Eventually(t, func() bool {
+		w := serveAdmin(a, http.MethodGet, "/cache/warm/"+job.ID, auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+
+		return job.Status == warmDone
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, &app.WarmReport{Total: 2, Succeeded: 2}, job.Report)
+
+	t.Run("unknown job", func(t *testing.T) {
+		w := serveAdmin(a, http.MethodGet, "/cache/warm/unknown", auth)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("invalid list", func(t *testing.T) {
+		w := serveAdminBody(a, http.MethodPost, "/cache/warm", auth, "100/50\n")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("invalid concurrency", func(t *testing.T) {
+		w := serveAdminBody(a, http.MethodPost, "/cache/warm?concurrency=100", auth, "100/50/example.com/a.jpg\n")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("finished jobs are forgotten", func(t *testing.T) {
+		allDone := func() bool {
+			a.jobsMu.Lock()
+			defer a.jobsMu.Unlock()
+
+			for _, job := range a.jobs {
+				if job.Status != warmDone {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		for i := 0; i < maxWarmJobs+4; i++ {
+			w := serveAdminBody(a, http.MethodPost, "/cache/warm", auth, "100/50/example.com/a.jpg\n")
+			require.Equal(t, http.StatusAccepted, w.Code)
+			require.Eventually(t, allDone, time.Second, time.Millisecond)
+		}
+
+		// Finished jobs are removed, when new job is started.
+		w := serveAdminBody(a, http.MethodPost, "/cache/warm", auth, "100/50/example.com/a.jpg\n")
+		require.Equal(t, http.StatusAccepted, w.Code)
+
+		a.jobsMu.Lock()
+		defer a.jobsMu.Unlock()
+
+		require.Len(t, a.jobs, maxWarmJobs)
+	})
+
+	t.Run("running jobs limit", func(t *testing.T) {
+		fa := &fakeAdmin{warm: make(chan struct{})}
+		a := NewAdmin("0", testToken, fa, nil, nopLogger{}, nil)
+
+		for i := 0; i < maxRunningWarmJobs; i++ {
+			w := serveAdminBody(a, http.MethodPost, "/cache/warm", auth, "100/50/example.com/a.jpg\n")
+			require.Equal(t, http.StatusAccepted, w.Code)
+		}
+
+		w := serveAdminBody(a, http.MethodPost, "/cache/warm", auth, "100/50/example.com/a.jpg\n")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+		// New job is accepted, when running ones finish.
+		close(fa.warm)
+
+		require.Eventually(t, func() bool {
+			w := serveAdminBody(a, http.MethodPost, "/cache/warm", auth, "100/50/example.com/a.jpg\n")
+			return w.Code == http.StatusAccepted
+		}, time.Second, time.Millisecond)
+	})
+}
+
+// Replica app, that records purges.
+type fakeReplica struct {
+	*fakeAdmin
+}
+
+func (fakeReplica) Fill(context.Context, string, string, string, map[string][]string) (*app.Preview, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (fakeReplica) Stat(string, string, string) (*app.Preview, error) {
+	return nil, nil
+}
+
+func TestPeerPurge(t *testing.T) {
+	auth := "Bearer " + testToken
+	secret := "peer-secret"
+
+	replica := fakeReplica{&fakeAdmin{removed: 2}}
+	srv := New("0", replica, nopLogger{}, Options{
+		Peers: peer.NewPool("http://replica", nil, peer.Options{Secret: secret}),
+	})
+
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+
+	peers := peer.NewPool("http://self", []string{ts.URL}, peer.Options{Timeout: time.Second, Secret: secret})
+
+	t.Run("purge is sent to replicas", func(t *testing.T) {
+		fa := &fakeAdmin{removed: 3}
+		replica.purged = nil
+
+		w := serveAdmin(NewAdmin("0", testToken, fa, peers, nopLogger{}, nil),
+			http.MethodDelete, "/cache/entries?prefix=example.com/img/", auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, []string{"prefix example.com/img/"}, fa.purged)
+		require.Equal(t, []string{"prefix example.com/img/"}, replica.purged)
+
+		var resp purgeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, purgeResponse{Removed: 3}, resp)
+	})
+
+	t.Run("flush is sent to replicas", func(t *testing.T) {
+		fa := &fakeAdmin{}
+		replica.purged = nil
+
+		w := serveAdmin(NewAdmin("0", testToken, fa, peers, nopLogger{}, nil), http.MethodDelete, "/cache", auth)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, []string{"flush"}, fa.purged)
+		require.Equal(t, []string{"flush"}, replica.purged)
+	})
+
+	t.Run("untrusted purge", func(t *testing.T) {
+		replica.purged = nil
+
+		for _, secret := range []string{"", "wrong"} {
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+peer.PurgePath, nil)
+			require.NoError(t, err)
+			if secret != "" {
+				req.Header.Set(peer.Header, secret)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+
+		require.Empty(t, replica.purged)
+	})
+
+	t.Run("replica failure", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+
+		fa := &fakeAdmin{removed: 1}
+		peers := peer.NewPool("http://self", []string{down.URL}, peer.Options{Timeout: time.Second, Secret: secret})
+
+		w := serveAdmin(NewAdmin("0", testToken, fa, peers, nopLogger{}, nil),
+			http.MethodDelete, "/cache/entries?key=100-50-example.com/a.jpg", auth)
+
+		// Local purge is done, replicas failure is reported.
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, []string{"key 100-50-example.com/a.jpg"}, fa.purged)
+
+		var resp purgeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, 1, resp.Removed)
+		require.Contains(t, resp.Error, down.URL)
+	})
+}
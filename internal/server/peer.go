@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Check if request is from other replica. Other requests get not found, as
+// peer API is not public.
+func (s *Server) trustPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.opts.Peers.Trusted(r.Header); !ok {
+			s.logger.Warn("untrusted peer request " + r.Method + " " + r.URL.String() + " from " + r.RemoteAddr)
+
+			http.NotFound(w, r)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Purge cache entries handler for other replica. Purge is not sent further.
+func (s *Server) peerPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	name, value, err := parsePurge(r.URL.Query())
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	removed, err := runPurge(s.app, name, value)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.logger.Info("purged " + strconv.Itoa(removed) + " cache files by " + name + " " + value + " from replica")
+
+	s.writePurge(w, removed)
+}
+
+// Flush cache handler for other replica.
+func (s *Server) peerFlushHandler(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.app.Flush()
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	s.logger.Info("flushed " + strconv.Itoa(removed) + " cache files from replica")
+
+	s.writePurge(w, removed)
+}
+
+// Write purge response.
+func (s *Server) writePurge(w http.ResponseWriter, removed int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(purgeResponse{Removed: removed})
+	if err != nil {
+		s.logger.Error(err.Error())
+	}
+}
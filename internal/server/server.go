@@ -1,10 +1,22 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/yakuninmax/imgpreviewer/internal/app"
+	"github.com/yakuninmax/imgpreviewer/internal/apperror"
+	"github.com/yakuninmax/imgpreviewer/internal/metrics"
+	"github.com/yakuninmax/imgpreviewer/internal/peer"
 )
 
 const (
@@ -13,8 +25,13 @@ const (
 	idleTimeout  = time.Second * 60
 )
 
-type app interface {
-	Fill(width, height, url string, headers map[string][]string) ([]byte, error)
+// Request headers, that make response private.
+var privateHeaders = []string{"Authorization", "Cookie"}
+
+type previewer interface {
+	purger
+	Fill(ctx context.Context, width, height, url string, headers map[string][]string) (*app.Preview, error)
+	Stat(width, height, url string) (*app.Preview, error)
 }
 
 type logger interface {
@@ -23,32 +40,60 @@ type logger interface {
 	Error(string)
 	Debug(string)
 }
+
+// Error response body.
+type errorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Remote server error, that can be relayed to client.
+type upstreamError interface {
+	Response() (int, http.Header, []byte)
+}
+
+// Server options.
+type Options struct {
+	ProxyErrors bool              // relay remote server errors as is
+	MaxAge      time.Duration     // response Cache-Control max-age
+	Metrics     *metrics.Registry // nil disables instrumentation
+	Peers       *peer.Pool        // replicas, that may send purges, nil disables peer API
+}
+
 type Server struct {
-	addr   string
-	app    app
-	logger logger
-	server *http.Server
+	addr      string
+	app       previewer
+	logger    logger
+	server    *http.Server
+	opts      Options
+	responses *metrics.Counter   // by status code
+	duration  *metrics.Histogram // request processing duration
+}
+
+// Response writer, that keeps status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
 }
 
-func New(port string, app app, logg logger) *Server {
+func New(port string, app previewer, logg logger, opts Options) *Server {
 	return &Server{
 		addr:   ":" + port,
 		app:    app,
 		logger: logg,
+		opts:   opts,
+		responses: opts.Metrics.Counter("imgpreviewer_responses_total",
+			"Number of preview responses by status code.", "code"),
+		duration: opts.Metrics.Histogram("imgpreviewer_request_duration_seconds",
+			"Preview request processing duration in seconds.", metrics.DurationBuckets),
 	}
 }
 
 func (s *Server) Start() error {
-	// Create new router.
-	mux := http.NewServeMux()
-
-	// Configure router.
-	mux.HandleFunc("/fill/{width}/{height}/{url...}", s.fillHandler)
-
 	// Configure server.
 	s.server = &http.Server{
 		Addr:         s.addr,
-		Handler:      mux,
+		Handler:      s.handler(),
 		WriteTimeout: writeTimeout,
 		ReadTimeout:  readTimeout,
 		IdleTimeout:  idleTimeout,
@@ -63,6 +108,21 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// Get router.
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/fill/{width}/{height}/{url...}", s.instrument(http.HandlerFunc(s.fillHandler)))
+
+	// Purges sent by other replicas.
+	if s.opts.Peers != nil {
+		mux.Handle("DELETE "+peer.PurgePath+"/entries", s.trustPeer(http.HandlerFunc(s.peerPurgeHandler)))
+		mux.Handle("DELETE "+peer.PurgePath, s.trustPeer(http.HandlerFunc(s.peerFlushHandler)))
+	}
+
+	return mux
+}
+
 func (s *Server) Stop(ctx context.Context) error {
 	err := s.server.Shutdown(ctx)
 	if err != nil {
@@ -72,26 +132,244 @@ func (s *Server) Stop(ctx context.Context) error {
 	return nil
 }
 
+// Count responses by status code, and observe request duration.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		// Nothing written means empty 200 response.
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		s.responses.Inc(strconv.Itoa(sw.status))
+		s.duration.Observe(time.Since(start).Seconds())
+	})
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Copy body from reader, so underlying writer can use sendfile for files.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return io.Copy(w.ResponseWriter, r)
+}
+
+// Get underlying writer for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // Resize handler.
 func (s *Server) fillHandler(w http.ResponseWriter, r *http.Request) {
 	s.logger.Debug("incoming request: " + r.URL.String())
 
+	// Request must be processed before server write timeout.
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+
+	// Answer conditional request from cached metadata, if image is not modified.
+	if isConditional(r) {
+		preview, err := s.app.Stat(r.PathValue("width"), r.PathValue("height"), r.PathValue("url"))
+		if err == nil && preview != nil && isNotModified(r, preview) {
+			s.writeNotModified(w, r, preview)
+			return
+		}
+	}
+
 	// Process image.
-	resizedImage, err := s.app.Fill(r.PathValue("width"), r.PathValue("height"), r.PathValue("url"), r.Header)
+	preview, err := s.app.Fill(ctx, r.PathValue("width"), r.PathValue("height"), r.PathValue("url"), r.Header)
 	if err != nil {
-		s.logger.Error(err.Error())
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		s.writeError(w, r, err)
 		return
 	}
 
-	// Return image.
-	w.Header().Set("Content-Type", "application/octet-stream")
-	_, err = w.Write(resizedImage)
-	if err != nil {
-		s.logger.Error(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var content io.ReadSeeker = bytes.NewReader(preview.Data)
+	if preview.Content != nil {
+		defer preview.Content.Close()
+		content = preview.Content
+	}
+
+	if isNotModified(r, preview) {
+		s.writeNotModified(w, r, preview)
 		return
 	}
 
+	// Return image, range requests are served too.
+	s.setHeaders(w, r, preview)
+	w.Header().Set("Content-Type", preview.ContentType)
+	http.ServeContent(w, r, "", preview.ModTime, content)
+
 	s.logger.Debug("request " + r.URL.String() + " successfully processed")
 }
+
+// Write not modified response.
+func (s *Server) writeNotModified(w http.ResponseWriter, r *http.Request, preview *app.Preview) {
+	s.setHeaders(w, r, preview)
+	w.WriteHeader(http.StatusNotModified)
+
+	s.logger.Debug("request " + r.URL.String() + " not modified")
+}
+
+// Set image validators and caching headers.
+func (s *Server) setHeaders(w http.ResponseWriter, r *http.Request, preview *app.Preview) {
+	hdr := w.Header()
+
+	if preview.ETag != "" {
+		hdr.Set("ETag", preview.ETag)
+	}
+
+	if !preview.ModTime.IsZero() {
+		hdr.Set("Last-Modified", preview.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	// Response to request with credentials must not be shared.
+	scope := "public"
+	for _, name := range privateHeaders {
+		if r.Header.Get(name) != "" {
+			scope = "private"
+			hdr.Add("Vary", name)
+		}
+	}
+
+	hdr.Set("Cache-Control", scope+", max-age="+strconv.Itoa(int(s.maxAge(preview).Seconds())))
+}
+
+// Get response max-age, clients must not keep preview longer than it is fresh.
+func (s *Server) maxAge(preview *app.Preview) time.Duration {
+	if preview.Expires.IsZero() {
+		return s.opts.MaxAge
+	}
+
+	return max(min(s.opts.MaxAge, time.Until(preview.Expires)), 0)
+}
+
+// Write error response.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	// Client has gone, nobody to answer.
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		s.logger.Debug("request " + r.URL.String() + " canceled by client")
+		return
+	}
+
+	// Relay remote server error, if enabled.
+	var ue upstreamError
+	if s.opts.ProxyErrors && errors.As(err, &ue) {
+		s.logger.Warn(err.Error())
+		s.relayError(w, ue)
+		return
+	}
+
+	code := apperror.StatusCode(err)
+
+	// Client mistakes are not service failures.
+	if code >= http.StatusInternalServerError {
+		s.logger.Error(err.Error())
+	} else {
+		s.logger.Warn(err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(errorResponse{Status: code, Error: err.Error()})
+	if err != nil {
+		s.logger.Error(err.Error())
+	}
+}
+
+// Write remote server error response as is. Remote content is served from
+// this service origin, so only passive content types are kept.
+func (s *Server) relayError(w http.ResponseWriter, ue upstreamError) {
+	code, hdr, body := ue.Response()
+
+	for name, values := range hdr {
+		w.Header()[name] = values
+	}
+
+	if !isPassiveType(w.Header().Get("Content-Type")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	_, err := w.Write(body)
+	if err != nil {
+		s.logger.Error(err.Error())
+	}
+}
+
+// Check if content type is image or JSON, SVG image may contain scripts.
+func isPassiveType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"):
+		return true
+	default:
+		return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	}
+}
+
+// Check if request has validators.
+func isConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// Check request validators against image, If-None-Match takes precedence.
+func isNotModified(r *http.Request, preview *app.Preview) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return preview.ETag != "" && matchETag(inm, preview.ETag)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || preview.ModTime.IsZero() {
+		return false
+	}
+
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	return !preview.ModTime.Truncate(time.Second).After(t)
+}
+
+// Check if If-None-Match list contains entity tag, using weak comparison.
+func matchETag(inm, etag string) bool {
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yakuninmax/imgpreviewer/internal/app"
+	"github.com/yakuninmax/imgpreviewer/internal/cache"
+	"github.com/yakuninmax/imgpreviewer/internal/downloader"
+)
+
+// Logger, that discards messages.
+type nopLogger struct{}
+
+func (nopLogger) Info(string)  {}
+func (nopLogger) Warn(string)  {}
+func (nopLogger) Error(string) {}
+func (nopLogger) Debug(string) {}
+
+func TestRelayError(t *testing.T) {
+	s := New("0", nil, nopLogger{}, Options{ProxyErrors: true})
+
+	tests := []struct {
+		name        string
+		contentType string
+		expected    string
+	}{
+		{"image", "image/png", "image/png"},
+		{"json", "application/json; charset=utf-8", "application/json; charset=utf-8"},
+		{"problem json", "application/problem+json", "application/problem+json"},
+		{"html", "text/html; charset=utf-8", "text/plain; charset=utf-8"},
+		{"svg", "image/svg+xml", "text/plain; charset=utf-8"},
+		{"missing", "", "text/plain; charset=utf-8"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr := http.Header{}
+			if tc.contentType != "" {
+				hdr.Set("Content-Type", tc.contentType)
+			}
+
+			err := &downloader.ResponseError{
+				Status:     "404 Not Found",
+				StatusCode: http.StatusNotFound,
+				Header:     hdr,
+				Body:       []byte("<script>alert(1)</script>"),
+			}
+
+			w := httptest.NewRecorder()
+			s.writeError(w, httptest.NewRequest(http.MethodGet, "/fill/1/1/example.com/a.png", nil), err)
+
+			require.Equal(t, http.StatusNotFound, w.Code)
+			require.Equal(t, tc.expected, w.Header().Get("Content-Type"))
+			require.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+			require.Equal(t, "<script>alert(1)</script>", w.Body.String())
+		})
+	}
+}
+
+// Response writer, that records ReadFrom calls.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readerFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+func TestStatusWriter(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	sw := &statusWriter{ResponseWriter: rec}
+
+	// Reader without WriterTo, so copy goes through ReadFrom.
+	n, err := io.Copy(sw, struct{ io.Reader }{strings.NewReader("image data")})
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	require.True(t, rec.readFrom)
+	require.Equal(t, http.StatusOK, sw.status)
+	require.Equal(t, "image data", rec.Body.String())
+
+	// Response controller reaches underlying writer.
+	require.NoError(t, http.NewResponseController(sw).Flush())
+	require.True(t, rec.Flushed)
+}
+
+func TestCacheControl(t *testing.T) {
+	s := New("0", nil, nopLogger{}, Options{MaxAge: time.Hour})
+
+	fresh := 10*time.Minute + 30*time.Second + 500*time.Millisecond
+
+	tests := []struct {
+		name     string
+		expires  time.Time
+		expected string
+	}{
+		{"no expiration", time.Time{}, "public, max-age=3600"},
+		{"fresh longer than max age", time.Now().Add(2 * time.Hour), "public, max-age=3600"},
+		{"fresh shorter than max age", time.Now().Add(fresh), "public, max-age=630"},
+		{"expired", time.Now().Add(-time.Minute), "public, max-age=0"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.setHeaders(w, httptest.NewRequest(http.MethodGet, "/fill/1/1/example.com/a.jpg", nil),
+				&app.Preview{Meta: cache.Meta{Expires: tc.expires}})
+
+			require.Equal(t, tc.expected, w.Header().Get("Cache-Control"))
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package singleflight
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// In-flight call.
+type call[T any] struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	val     T
+	err     error
+}
+
+// Group deduplicates concurrent calls with the same key.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+// Execute fn once for all concurrent callers with the same key,
+// every caller gets the same result. Each caller stops waiting when its
+// context is done, and fn context is canceled when no callers are left.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+
+	// Start new call, if no call in flight.
+	c, exists := g.calls[key]
+	if !exists {
+		// Call context keeps caller values, but not its cancellation.
+		cctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+		c = &call[T]{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = c
+
+		go g.run(cctx, key, c, fn)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+
+		// Cancel call, if nobody waits for it.
+		if c.waiters == 0 {
+			c.cancel()
+			g.forget(key, c)
+		}
+		g.mu.Unlock()
+
+		var zero T
+
+		return zero, ctx.Err()
+	}
+}
+
+// Run call and release waiters.
+func (g *Group[T]) run(ctx context.Context, key string, c *call[T], fn func(context.Context) (T, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("call %s panicked: %v", key, r)
+		}
+
+		g.mu.Lock()
+		g.forget(key, c)
+		g.mu.Unlock()
+
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn(ctx)
+}
+
+// Remove call from group, if it is not replaced yet.
+func (g *Group[T]) forget(key string, c *call[T]) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
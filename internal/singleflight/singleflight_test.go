@@ -0,0 +1,146 @@
+package singleflight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("single call", func(t *testing.T) {
+		var g Group[string]
+
+		v, err := g.Do(ctx, "key", func(context.Context) (string, error) {
+			return "value", nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, "value", v)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var g Group[string]
+		testErr := errors.New("test error")
+
+		_, err := g.Do(ctx, "key", func(context.Context) (string, error) {
+			return "", testErr
+		})
+		require.ErrorIs(t, err, testErr)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		var g Group[string]
+
+		_, err := g.Do(ctx, "key", func(context.Context) (string, error) {
+			panic("test panic")
+		})
+		require.ErrorContains(t, err, "test panic")
+	})
+
+	t.Run("concurrent calls", func(t *testing.T) {
+		var g Group[int]
+		var calls int32
+		var wg sync.WaitGroup
+
+		start := make(chan struct{})
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				v, err := g.Do(ctx, "key", func(context.Context) (int, error) {
+					atomic.AddInt32(&calls, 1)
+					<-start
+
+					return 42, nil
+				})
+				require.NoError(t, err)
+				require.Equal(t, 42, v)
+			}()
+		}
+
+		// Let all goroutines join the call.
+		time.Sleep(100 * time.Millisecond)
+		close(start)
+		wg.Wait()
+
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("sequential calls", func(t *testing.T) {
+		var g Group[int]
+		var calls int
+
+		for i := 0; i < 3; i++ {
+			_, err := g.Do(ctx, "key", func(context.Context) (int, error) {
+				calls++
+				return calls, nil
+			})
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("one of callers canceled", func(t *testing.T) {
+		var g Group[int]
+
+		start := make(chan struct{})
+		cctx, cancel := context.WithCancel(ctx)
+
+		fn := func(ctx context.Context) (int, error) {
+			select {
+			case <-start:
+				return 42, nil
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+
+		res := make(chan error)
+		go func() {
+			_, err := g.Do(ctx, "key", fn)
+			res <- err
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+
+		_, err := g.Do(cctx, "key", fn)
+		require.ErrorIs(t, err, context.Canceled)
+
+		// Call still runs for remaining caller.
+		close(start)
+		require.NoError(t, <-res)
+	})
+
+	t.Run("all callers canceled", func(t *testing.T) {
+		var g Group[int]
+
+		cctx, cancel := context.WithCancel(ctx)
+		canceled := make(chan struct{})
+
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err := g.Do(cctx, "key", func(ctx context.Context) (int, error) {
+			<-ctx.Done()
+			close(canceled)
+
+			return 0, ctx.Err()
+		})
+		require.ErrorIs(t, err, context.Canceled)
+
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("call is not canceled")
+		}
+	})
+}
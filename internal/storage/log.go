@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Name of log file in storage folder.
+const logName = "data.log"
+
+// Log record ops.
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// Record header is op, name length, data length and checksum of name and data.
+const recordHeaderSize = 1 + 2 + 4 + 4
+
+// Default min size of dead records to compact log.
+const defaultCompactMinSize = 4 << 20
+
+var ErrNameTooLong = errors.New("file name is too long")
+
+type LogOptions struct {
+	Sync           bool  // flush log to disk on every write
+	CompactMinSize int64 // min size of dead records to compact log, default 4MB
+}
+
+// Log storage keeps all files in single append-only file. Overwritten and deleted
+// files are dropped, when log is compacted.
+type Log struct {
+	mu    sync.RWMutex
+	path  string
+	file  *os.File
+	size  int64 // log size
+	dead  int64 // size of overwritten and deleted records
+	index map[string]record
+	opts  LogOptions
+}
+
+// Location of file record in log.
+type record struct {
+	offset  int64
+	nameLen int
+	size    int64 // data size
+}
+
+func (r record) len() int64 {
+	return recordHeaderSize + int64(r.nameLen) + r.size
+}
+
+// New log storage. Persistent storage uses given path as is, otherwise
+// random temp folder is created inside it. Record damaged by interrupted
+// write at log tail is dropped, other damaged records fail with ErrCorrupted.
+func NewLog(path string, persistent bool, opts LogOptions) (*Log, error) {
+	path, err := createStorageFolder(path, persistent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove files left by interrupted compaction.
+	err = removeTemp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CompactMinSize <= 0 {
+		opts.CompactMinSize = defaultCompactMinSize
+	}
+
+	file, err := os.OpenFile(filepath.Join(path, logName), os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+
+	l := &Log{
+		path:  path,
+		file:  file,
+		index: make(map[string]record),
+		opts:  opts,
+	}
+
+	err = l.load()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to load log: %w", err)
+	}
+
+	return l, nil
+}
+
+// Get log file path.
+func (l *Log) Path() string {
+	return filepath.Join(l.path, logName)
+}
+
+// Write file to log.
+func (l *Log) Write(_ context.Context, name string, data []byte) error {
+	rec, err := encodeRecord(opPut, name, data)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err = l.append(rec)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if old, exists := l.index[name]; exists {
+		l.dead += old.len()
+	}
+
+	l.index[name] = record{l.size - int64(len(rec)), len(name), int64(len(data))}
+
+	return l.maybeCompact()
+}
+
+// Write file from reader. Record checksum covers whole data, so it is
+// buffered before append.
+func (l *Log) WriteFrom(ctx context.Context, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return int64(len(data)), l.Write(ctx, name, data)
+}
+
+// Read file from log. Returns ErrCorrupted, if record checksum does not match.
+func (l *Log) Read(_ context.Context, name string) ([]byte, error) {
+	l.mu.RLock()
+
+	r, exists := l.index[name]
+	if !exists {
+		l.mu.RUnlock()
+		return nil, fmt.Errorf("failed to read file: %w", os.ErrNotExist)
+	}
+
+	rec := make([]byte, r.len())
+	_, err := l.file.ReadAt(rec, r.offset)
+	l.mu.RUnlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	op, recName, data, ok := decodeRecord(rec)
+	if !ok || op != opPut || recName != name {
+		return nil, fmt.Errorf("failed to read file %s: %w", name, ErrCorrupted)
+	}
+
+	return data, nil
+}
+
+// Open file for read. File is read into memory, so log compaction does not
+// affect readers.
+func (l *Log) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	data, err := l.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBytesReader(data), nil
+}
+
+// Delete file from log.
+func (l *Log) Delete(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	old, exists := l.index[name]
+	if !exists {
+		return fmt.Errorf("failed to delete file: %w", os.ErrNotExist)
+	}
+
+	rec, err := encodeRecord(opDelete, name, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	err = l.append(rec)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	delete(l.index, name)
+	l.dead += old.len() + int64(len(rec))
+
+	return l.maybeCompact()
+}
+
+// List files in log, returns file sizes by names.
+func (l *Log) List() (map[string]int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	files := make(map[string]int64, len(l.index))
+	for name, r := range l.index {
+		files[name] = r.size
+	}
+
+	return files, nil
+}
+
+// Rewrite log without overwritten and deleted files.
+func (l *Log) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.compact()
+}
+
+// Close log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+// Close and remove log storage folder.
+func (l *Log) Clean() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_ = l.file.Close()
+
+	err := os.RemoveAll(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to remove temp cache folder: %w", err)
+	}
+
+	return nil
+}
+
+// Replay log into index, and truncate damaged tail.
+func (l *Log) load() error {
+	stat, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(l.file)
+	header := make([]byte, recordHeaderSize)
+
+	var (
+		offset int64
+		buf    []byte
+	)
+
+	for {
+		_, err := io.ReadFull(r, header)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		nameLen := int(binary.BigEndian.Uint16(header[1:]))
+		size := int64(binary.BigEndian.Uint32(header[3:]))
+		end := offset + recordHeaderSize + int64(nameLen) + size
+
+		// Record is cut off.
+		if end > stat.Size() {
+			break
+		}
+
+		buf = slices.Grow(buf[:0], recordHeaderSize+nameLen+int(size))
+		buf = append(buf, header...)
+		buf = buf[:recordHeaderSize+nameLen+int(size)]
+
+		_, err = io.ReadFull(r, buf[recordHeaderSize:])
+		if err != nil {
+			return err
+		}
+
+		// Damaged last record is interrupted write. Damaged record followed by
+		// others is not dropped with them, as its length may be damaged too.
+		op, name, _, ok := decodeRecord(buf)
+		if !ok {
+			if end == stat.Size() {
+				break
+			}
+
+			return fmt.Errorf("failed to load log record at offset %d: %w", offset, ErrCorrupted)
+		}
+
+		if old, exists := l.index[name]; exists {
+			l.dead += old.len()
+		}
+
+		switch op {
+		case opPut:
+			l.index[name] = record{offset, nameLen, size}
+		case opDelete:
+			delete(l.index, name)
+			l.dead += int64(len(buf))
+		}
+
+		offset += int64(len(buf))
+	}
+
+	// Drop damaged record at log tail.
+	err = l.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+
+	l.size = offset
+
+	return nil
+}
+
+// Append record to log, must be called with lock held.
+func (l *Log) append(rec []byte) error {
+	// Failed write is overwritten by next record.
+	_, err := l.file.WriteAt(rec, l.size)
+	if err != nil {
+		return err
+	}
+
+	if l.opts.Sync {
+		err = l.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	l.size += int64(len(rec))
+
+	return nil
+}
+
+// Compact log, if dead records take more than half of it.
+func (l *Log) maybeCompact() error {
+	if l.dead < l.opts.CompactMinSize || l.dead*2 < l.size {
+		return nil
+	}
+
+	return l.compact()
+}
+
+// Copy live records to new log, and replace old log with it. Must be called with lock held.
+func (l *Log) compact() error {
+	temp, err := os.CreateTemp(l.path, tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to compact log: %w", err)
+	}
+
+	// Remove temp file, if not renamed.
+	defer os.Remove(temp.Name())
+
+	index, size, err := l.copyTo(temp)
+	if err == nil && l.opts.Sync {
+		err = temp.Sync()
+	}
+
+	if err == nil {
+		err = os.Rename(temp.Name(), l.Path())
+	}
+
+	if err == nil && l.opts.Sync {
+		err = syncDir(l.path)
+	}
+
+	if err != nil {
+		_ = temp.Close()
+		return fmt.Errorf("failed to compact log: %w", err)
+	}
+
+	_ = l.file.Close()
+
+	l.file = temp
+	l.index = index
+	l.size = size
+	l.dead = 0
+
+	return nil
+}
+
+// Copy live records in log order, returns new index and log size.
+func (l *Log) copyTo(file *os.File) (map[string]record, int64, error) {
+	names := make([]string, 0, len(l.index))
+	for name := range l.index {
+		names = append(names, name)
+	}
+
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Compare(l.index[a].offset, l.index[b].offset)
+	})
+
+	w := bufio.NewWriter(file)
+	index := make(map[string]record, len(names))
+	offset := int64(0)
+
+	for _, name := range names {
+		r := l.index[name]
+
+		_, err := io.Copy(w, io.NewSectionReader(l.file, r.offset, r.len()))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		index[name] = record{offset, r.nameLen, r.size}
+		offset += r.len()
+	}
+
+	return index, offset, w.Flush()
+}
+
+// Encode log record.
+func encodeRecord(op byte, name string, data []byte) ([]byte, error) {
+	if len(name) > math.MaxUint16 {
+		return nil, ErrNameTooLong
+	}
+
+	if int64(len(data)) > math.MaxUint32 {
+		return nil, fmt.Errorf("file is too large: %d bytes", len(data))
+	}
+
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+len(name)+len(data))
+	rec[0] = op
+	binary.BigEndian.PutUint16(rec[1:], uint16(len(name)))
+	binary.BigEndian.PutUint32(rec[3:], uint32(len(data)))
+
+	rec = append(rec, name...)
+	rec = append(rec, data...)
+
+	binary.BigEndian.PutUint32(rec[7:], crc32.Checksum(rec[recordHeaderSize:], crcTable))
+
+	return rec, nil
+}
+
+// Decode log record, returns false if record is damaged.
+func decodeRecord(rec []byte) (byte, string, []byte, bool) {
+	if len(rec) < recordHeaderSize {
+		return 0, "", nil, false
+	}
+
+	op := rec[0]
+	nameLen := int(binary.BigEndian.Uint16(rec[1:]))
+	size := int(binary.BigEndian.Uint32(rec[3:]))
+
+	if op != opPut && op != opDelete || len(rec) != recordHeaderSize+nameLen+size {
+		return 0, "", nil, false
+	}
+
+	if binary.BigEndian.Uint32(rec[7:]) != crc32.Checksum(rec[recordHeaderSize:], crcTable) {
+		return 0, "", nil, false
+	}
+
+	body := rec[recordHeaderSize:]
+
+	return op, string(body[:nameLen]), body[nameLen:], true
+}
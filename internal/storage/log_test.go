@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+
+	path := t.TempDir()
+
+	l, err := NewLog(path, true, LogOptions{Sync: true, CompactMinSize: 1})
+	require.NoError(t, err)
+
+	t.Run("restore log", func(t *testing.T) {
+		require.NoError(t, l.Write(ctx, "file1", []byte("test1")))
+		require.NoError(t, l.Write(ctx, "file2", []byte("test2")))
+		require.NoError(t, l.Close())
+
+		l, err = NewLog(path, true, LogOptions{CompactMinSize: 1})
+		require.NoError(t, err)
+
+		data, err := l.Read(ctx, "file2")
+		require.NoError(t, err)
+		require.Equal(t, []byte("test2"), data)
+	})
+
+	t.Run("compact log", func(t *testing.T) {
+		stat, err := os.Stat(l.Path())
+		require.NoError(t, err)
+
+		// Dead records take more than half of log.
+		require.NoError(t, l.Write(ctx, "file1", []byte("test1")))
+		require.NoError(t, l.Delete("file2"))
+
+		compacted, err := os.Stat(l.Path())
+		require.NoError(t, err)
+		require.Less(t, compacted.Size(), stat.Size())
+		require.Zero(t, l.dead)
+
+		data, err := l.Read(ctx, "file1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("test1"), data)
+	})
+
+	t.Run("interrupted write", func(t *testing.T) {
+		require.NoError(t, l.Write(ctx, "file3", []byte("test3")))
+		require.NoError(t, l.Close())
+
+		// Cut last record.
+		stat, err := os.Stat(l.Path())
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(l.Path(), stat.Size()-2))
+
+		l, err = NewLog(path, true, LogOptions{})
+		require.NoError(t, err)
+
+		files, err := l.List()
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{"file1": 5}, files)
+
+		// Log is appended after last complete record.
+		require.NoError(t, l.Write(ctx, "file3", []byte("test3")))
+
+		data, err := l.Read(ctx, "file3")
+		require.NoError(t, err)
+		require.Equal(t, []byte("test3"), data)
+	})
+
+	t.Run("corrupted record", func(t *testing.T) {
+		file, err := os.OpenFile(filepath.Join(path, logName), os.O_RDWR, filePerm)
+		require.NoError(t, err)
+
+		// Flip last data byte.
+		r := l.index["file3"]
+		_, err = file.WriteAt([]byte{0}, r.offset+r.len()-1)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		_, err = l.Read(ctx, "file3")
+		require.ErrorIs(t, err, ErrCorrupted)
+	})
+
+	t.Run("corrupted record at tail", func(t *testing.T) {
+		require.NoError(t, l.Close())
+
+		l, err = NewLog(path, true, LogOptions{})
+		require.NoError(t, err)
+
+		files, err := l.List()
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{"file1": 5}, files)
+	})
+
+	t.Run("corrupted record before tail", func(t *testing.T) {
+		require.NoError(t, l.Write(ctx, "file3", []byte("test3")))
+		require.NoError(t, l.Write(ctx, "file4", []byte("test4")))
+		require.NoError(t, l.Close())
+
+		stat, err := os.Stat(l.Path())
+		require.NoError(t, err)
+
+		file, err := os.OpenFile(l.Path(), os.O_RDWR, filePerm)
+		require.NoError(t, err)
+
+		// Flip last data byte of record followed by other record.
+		r := l.index["file3"]
+		_, err = file.WriteAt([]byte{0}, r.offset+r.len()-1)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		_, err = NewLog(path, true, LogOptions{})
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		// Records after damaged one are kept.
+		damaged, err := os.Stat(l.Path())
+		require.NoError(t, err)
+		require.Equal(t, stat.Size(), damaged.Size())
+
+		require.NoError(t, os.Truncate(l.Path(), r.offset))
+
+		l, err = NewLog(path, true, LogOptions{})
+		require.NoError(t, err)
+	})
+
+	require.NoError(t, l.Clean())
+	require.NoDirExists(t, path)
+}
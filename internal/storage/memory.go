@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Memory storage keeps files in process memory, nothing survives restart.
+type Memory struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		files: make(map[string][]byte),
+	}
+}
+
+// Get storage path.
+func (m *Memory) Path() string {
+	return "memory"
+}
+
+// Write file to storage.
+func (m *Memory) Write(_ context.Context, name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[name] = bytes.Clone(data)
+
+	return nil
+}
+
+// Write file from reader. Memory storage keeps whole file anyway.
+func (m *Memory) WriteFrom(ctx context.Context, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return int64(len(data)), m.Write(ctx, name, data)
+}
+
+// Read file from storage, data is shared and must not be modified.
+func (m *Memory) Read(_ context.Context, name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, exists := m.files[name]
+	if !exists {
+		return nil, fmt.Errorf("failed to read file: %w", os.ErrNotExist)
+	}
+
+	return data, nil
+}
+
+// Open file for read.
+func (m *Memory) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	data, err := m.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBytesReader(data), nil
+}
+
+// Delete file from storage.
+func (m *Memory) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.files[name]; !exists {
+		return fmt.Errorf("failed to delete file: %w", os.ErrNotExist)
+	}
+
+	delete(m.files, name)
+
+	return nil
+}
+
+// List files in storage, returns file sizes by names.
+func (m *Memory) List() (map[string]int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := make(map[string]int64, len(m.files))
+	for name, data := range m.files {
+		files[name] = int64(len(data))
+	}
+
+	return files, nil
+}
+
+// Remove all files.
+func (m *Memory) Clean() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files = make(map[string][]byte)
+
+	return nil
+}
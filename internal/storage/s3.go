@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Object metadata header with data checksum.
+const checksumHeader = "X-Amz-Meta-Checksum"
+
+// Default S3 request timeout.
+const defaultS3Timeout = 30 * time.Second
+
+var ErrS3Request = errors.New("s3 request failed")
+
+// S3 compatible object storage options.
+type S3Options struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region    string // default us-east-1
+	Bucket    string
+	Prefix    string // objects key prefix
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration // request timeout, default 30s
+	Client    *http.Client  // optional http client
+}
+
+// S3 storage keeps files as objects in S3 compatible bucket. Requests use
+// path-style addressing, so any S3 compatible server works.
+type S3 struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	prefix   string
+	access   string
+	secret   string
+	timeout  time.Duration
+	client   *http.Client
+	now      func() time.Time
+}
+
+// New S3 storage. Persistent storage uses given prefix as is, otherwise
+// random temp prefix is added to it.
+func NewS3(opts S3Options, persistent bool) (*S3, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse s3 endpoint: %w", err)
+	}
+
+	prefix := strings.Trim(opts.Prefix, "/")
+	if !persistent {
+		dir, err := getRandomName()
+		if err != nil {
+			return nil, err
+		}
+
+		prefix = path.Join(prefix, dir)
+	}
+
+	s := &S3{
+		endpoint: endpoint,
+		region:   opts.Region,
+		bucket:   opts.Bucket,
+		prefix:   prefix,
+		access:   opts.AccessKey,
+		secret:   opts.SecretKey,
+		timeout:  opts.Timeout,
+		client:   opts.Client,
+		now:      time.Now,
+	}
+
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	if s.timeout == 0 {
+		s.timeout = defaultS3Timeout
+	}
+
+	if s.client == nil {
+		s.client = &http.Client{}
+	}
+
+	return s, nil
+}
+
+// Get storage path.
+func (s *S3) Path() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+// Write file to storage.
+func (s *S3) Write(ctx context.Context, name string, data []byte) error {
+	header := http.Header{}
+	header.Set(checksumHeader, checksum(data))
+
+	resp, err := s.do(ctx, http.MethodPut, s.key(name), nil, header, data)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Write file from reader. Request is signed with payload hash, so data
+// is buffered before upload.
+func (s *S3) WriteFrom(ctx context.Context, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return int64(len(data)), s.Write(ctx, name, data)
+}
+
+// Read file from storage. Returns ErrCorrupted, if object checksum does not match.
+func (s *S3) Read(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if sum := resp.Header.Get(checksumHeader); sum != "" && sum != checksum(data) {
+		return nil, fmt.Errorf("failed to read file %s: %w", name, ErrCorrupted)
+	}
+
+	return data, nil
+}
+
+// Open file for read. Object is read into memory, as seeking needs range requests.
+func (s *S3) Open(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	data, err := s.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBytesReader(data), nil
+}
+
+// Delete file from storage.
+func (s *S3) Delete(name string) error {
+	resp, err := s.do(context.Background(), http.MethodDelete, s.key(name), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List files in storage, returns file sizes by names.
+func (s *S3) List() (map[string]int64, error) {
+	files := make(map[string]int64)
+
+	err := s.list(func(key string, size int64) {
+		files[strings.TrimPrefix(key, s.key(""))] = size
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	return files, nil
+}
+
+// Remove all storage objects.
+func (s *S3) Clean() error {
+	files, err := s.List()
+	if err != nil {
+		return fmt.Errorf("failed to remove temp cache objects: %w", err)
+	}
+
+	for name := range files {
+		err := s.Delete(name)
+		if err != nil {
+			return fmt.Errorf("failed to remove temp cache objects: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// List objects under storage prefix, page by page.
+func (s *S3) list(fn func(key string, size int64)) error {
+	var token string
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+
+		// Bucket without prefix is listed whole.
+		if s.prefix != "" {
+			query.Set("prefix", s.prefix+"/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(context.Background(), http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse objects list: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			fn(obj.Key, obj.Size)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// Get object key for file name.
+func (s *S3) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+
+	return s.prefix + "/" + name
+}
+
+// Send signed request for bucket object, or bucket itself for empty key.
+// Returns os.ErrNotExist for missing object. Request is bound by storage timeout
+// and given context.
+func (s *S3) do(
+	ctx context.Context, method, key string, query url.Values, header http.Header, body []byte,
+) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+
+	u := *s.endpoint
+	u.Path = path.Join("/", s.endpoint.Path, s.bucket, key)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Cancel context, when body is closed.
+	resp.Body = &cancelBody{resp.Body, cancel}
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		if resp.StatusCode == http.StatusNotFound && bytes.Contains(msg, []byte("NoSuchKey")) {
+			return nil, os.ErrNotExist
+		}
+
+		return nil, fmt.Errorf("%w: %s %s: %s", ErrS3Request, method, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return resp, nil
+}
+
+// Sign request with AWS signature version 4.
+func (s *S3) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	// Canonical headers are host and all set headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secret), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// Get data checksum as hex string.
+func checksum(data []byte) string {
+	return strconv.FormatUint(uint64(crc32.Checksum(data, crcTable)), 16)
+}
+
+// Response body, which cancels request context on close.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
@@ -1,32 +1,116 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
 
-var ErrPathIsNotDir = errors.New("given path is not a dir")
+// Permissions of storage files and dirs, only service user has access.
+const (
+	filePerm = 0o600
+	dirPerm  = 0o700
+)
+
+// Prefix of files being written, they are renamed when complete.
+const tempPrefix = ".tmp-"
+
+// Age of temp file to consider it abandoned. Younger files may be written by
+// other process sharing storage folder.
+const tempMaxAge = time.Hour
+
+// Fan-out dirs name length, and max number of levels.
+const (
+	fanOutWidth = 2
+	MaxFanOut   = 3
+)
+
+// File header is magic and data checksum.
+const headerSize = 8
+
+var magic = []byte("impr")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Storage backends.
+const (
+	BackendFS     = "fs"
+	BackendMemory = "memory"
+	BackendLog    = "log"
+	BackendS3     = "s3"
+)
+
+var (
+	ErrPathIsNotDir   = errors.New("given path is not a dir")
+	ErrCorrupted      = errors.New("file is corrupted")
+	ErrUnknownBackend = errors.New("unknown storage backend")
+)
 
 type Storage struct {
-	path string
+	path   string
+	sync   bool
+	fanOut int // number of nested dirs levels, zero means flat layout
 }
 
-func New(path string) (*Storage, error) {
-	tmp, err := createFolder(path)
+type Option func(*Storage)
+
+// Flush files and dir to disk on every write, so written files survive power loss.
+func WithSync(sync bool) Option {
+	return func(s *Storage) {
+		s.sync = sync
+	}
+}
+
+// Spread files over nested dirs named by file name prefixes, e.g. ab/cd/abcdef,
+// so dirs stay small. Levels are limited to MaxFanOut.
+func WithFanOut(levels int) Option {
+	return func(s *Storage) {
+		s.fanOut = min(max(levels, 0), MaxFanOut)
+	}
+}
+
+// New storage. Persistent storage uses given path as is, otherwise
+// random temp folder is created inside it.
+func New(path string, persistent bool, opts ...Option) (*Storage, error) {
+	path, err := createStorageFolder(path, persistent)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Storage{
+		path: path,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// Remove files left by interrupted writes.
+	err = removeTemp(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Move files stored with other layout.
+	err = s.migrate()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Storage{
-		path: tmp,
-	}, nil
+	return s, nil
 }
 
 // Get storage path.
@@ -34,11 +118,10 @@ func (s *Storage) Path() string {
 	return s.path
 }
 
-// Write file to storage.
-func (s *Storage) Write(name string, data []byte) error {
-	file := filepath.Join(s.path, name)
-
-	err := os.WriteFile(file, data, os.ModePerm.Perm())
+// Write file to storage. File is written to temp file and renamed,
+// so it is either complete or missing after crash.
+func (s *Storage) Write(_ context.Context, name string, data []byte) error {
+	_, err := s.writeFrom(name, bytes.NewReader(data))
 	if err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
@@ -46,21 +129,147 @@ func (s *Storage) Write(name string, data []byte) error {
 	return nil
 }
 
-// Read file from storage.
-func (s *Storage) Read(name string) ([]byte, error) {
-	file := filepath.Join(s.path, name)
+// Write file from reader, without buffering it in memory. Returns number of
+// bytes written.
+func (s *Storage) WriteFrom(_ context.Context, name string, r io.Reader) (int64, error) {
+	n, err := s.writeFrom(name, r)
+	if err != nil {
+		return n, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return n, nil
+}
+
+func (s *Storage) writeFrom(name string, r io.Reader) (int64, error) {
+	temp, err := os.CreateTemp(s.path, tempPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+
+	// Remove temp file, if not renamed.
+	defer os.Remove(temp.Name())
+
+	// Reserve header, checksum is known when data is written.
+	_, err = temp.Write(make([]byte, headerSize))
+	if err != nil {
+		_ = temp.Close()
+		return 0, err
+	}
+
+	crc := crc32.New(crcTable)
+
+	n, err := io.Copy(io.MultiWriter(temp, crc), r)
+	if err != nil {
+		_ = temp.Close()
+		return n, err
+	}
+
+	_, err = temp.WriteAt(sumHeader(crc.Sum32()), 0)
+	if err != nil {
+		_ = temp.Close()
+		return n, err
+	}
+
+	if s.sync {
+		err = temp.Sync()
+		if err != nil {
+			_ = temp.Close()
+			return n, err
+		}
+	}
+
+	err = temp.Close()
+	if err != nil {
+		return n, err
+	}
+
+	file := s.filePath(name)
+
+	err = os.MkdirAll(filepath.Dir(file), dirPerm)
+	if err != nil {
+		return n, err
+	}
+
+	err = os.Rename(temp.Name(), file)
+	if err != nil {
+		return n, err
+	}
+
+	// Flush rename.
+	if s.sync {
+		return n, syncDir(filepath.Dir(file))
+	}
+
+	return n, nil
+}
+
+// Read file from storage. Returns ErrCorrupted, if file checksum does not match.
+func (s *Storage) Read(_ context.Context, name string) ([]byte, error) {
+	file := s.filePath(name)
 	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	return data, nil
+	if len(data) < headerSize || !bytes.Equal(data[:headerSize], header(data[headerSize:])) {
+		return nil, fmt.Errorf("failed to read file %s: %w", name, ErrCorrupted)
+	}
+
+	return data[headerSize:], nil
+}
+
+// Open file for streaming read. File checksum is verified on open, so damaged
+// file is never partially sent, and range reads are verified too.
+func (s *Storage) Open(_ context.Context, name string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(s.filePath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	header := make([]byte, headerSize)
+
+	_, err = io.ReadFull(file, header)
+	switch {
+	// File is shorter than header.
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open file %s: %w", name, ErrCorrupted)
+	case err != nil:
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	case !bytes.Equal(header[:len(magic)], magic):
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open file %s: %w", name, ErrCorrupted)
+	}
+
+	data := io.NewSectionReader(file, headerSize, stat.Size()-headerSize)
+
+	// Data is read once more on open, it is likely in page cache afterwards.
+	crc := crc32.New(crcTable)
+	_, err = io.Copy(crc, data)
+	if err != nil || crc.Sum32() != binary.BigEndian.Uint32(header[len(magic):]) {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open file %s: %w", name, ErrCorrupted)
+	}
+
+	_, err = data.Seek(0, io.SeekStart)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return &fileReader{data, file}, nil
 }
 
 // Delete file from storage.
 func (s *Storage) Delete(name string) error {
-	filePath := filepath.Join(s.path, name)
-	err := os.Remove(filePath)
+	err := os.Remove(s.filePath(name))
 	if err != nil {
 		return err
 	}
@@ -68,6 +277,27 @@ func (s *Storage) Delete(name string) error {
 	return nil
 }
 
+// List files in storage, returns file data sizes by names.
+func (s *Storage) List() (map[string]int64, error) {
+	files := make(map[string]int64)
+
+	err := s.walk(func(path string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		files[entry.Name()] = max(0, info.Size()-headerSize)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	return files, nil
+}
+
 // Remove storage temp dir.
 func (s *Storage) Clean() error {
 	err := os.RemoveAll(s.path)
@@ -78,33 +308,208 @@ func (s *Storage) Clean() error {
 	return nil
 }
 
-// Create cache temp folder.
-func createFolder(path string) (string, error) {
-	// Get dir name from time.
+// Create storage folder. Persistent storage uses given path as is, otherwise
+// random temp folder is created inside it. Returns storage folder path.
+func createStorageFolder(path string, persistent bool) (string, error) {
+	err := createFolder(path)
+	if err != nil {
+		return "", err
+	}
+
+	if persistent {
+		return path, nil
+	}
+
 	dir, err := getRandomName()
 	if err != nil {
 		return "", err
 	}
 
-	tmp := filepath.Join(path, dir)
+	path = filepath.Join(path, dir)
 
+	return path, createFolder(path)
+}
+
+// Create cache folder.
+func createFolder(path string) error {
 	// Check if given path exists.
 	stat, err := os.Stat(path)
 
-	// If path not exists, or exists and it is dir, create temp dir.
-	if errors.Is(err, os.ErrNotExist) || stat.IsDir() {
-		if err := os.MkdirAll(tmp, os.ModePerm); err != nil {
-			return "", fmt.Errorf("failed to create cache dir: %w", err)
+	// If path not exists, create dir.
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(path, dirPerm); err != nil {
+			return fmt.Errorf("failed to create cache dir: %w", err)
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get dir: %w", err)
+	}
+
+	if !stat.IsDir() {
+		return ErrPathIsNotDir
+	}
+
+	return nil
+}
+
+// Stored file data reader.
+type fileReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *fileReader) Close() error {
+	return r.file.Close()
+}
+
+// In-memory file reader.
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func newBytesReader(data []byte) *bytesReader {
+	return &bytesReader{bytes.NewReader(data)}
+}
+
+func (r *bytesReader) Close() error {
+	return nil
+}
+
+// Get file path for current layout. Names shorter than fan-out dirs are kept in root.
+func (s *Storage) filePath(name string) string {
+	if len(name) < s.fanOut*fanOutWidth {
+		return filepath.Join(s.path, name)
+	}
+
+	parts := make([]string, 0, s.fanOut+2)
+	parts = append(parts, s.path)
+
+	for i := 0; i < s.fanOut; i++ {
+		parts = append(parts, name[i*fanOutWidth:(i+1)*fanOutWidth])
+	}
+
+	return filepath.Join(append(parts, name)...)
+}
+
+// Call fn for every stored file, temp files are skipped.
+func (s *Storage) walk(fn func(path string, entry fs.DirEntry) error) error {
+	return filepath.WalkDir(s.path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+
+		return fn(path, entry)
+	})
+}
+
+// Move files to current layout paths, and remove empty dirs.
+func (s *Storage) migrate() error {
+	moves := make(map[string]string)
+	var dirs []string
+
+	err := filepath.WalkDir(s.path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() && path != s.path {
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate storage: %w", err)
+	}
+
+	err = s.walk(func(path string, entry fs.DirEntry) error {
+		if file := s.filePath(entry.Name()); file != path {
+			moves[path] = file
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate storage: %w", err)
+	}
+
+	for from, to := range moves {
+		err := os.MkdirAll(filepath.Dir(to), dirPerm)
+		if err != nil {
+			return fmt.Errorf("failed to migrate storage: %w", err)
 		}
-	} else {
-		if !stat.IsDir() {
-			return "", ErrPathIsNotDir
+
+		err = os.Rename(from, to)
+		if err != nil {
+			return fmt.Errorf("failed to migrate storage: %w", err)
 		}
+	}
+
+	// Remove empty dirs, nested dirs first. Non-empty dirs are kept.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+
+	return nil
+}
 
-		return "", fmt.Errorf("failed to get dir: %w", err)
+// Remove abandoned temp files in dir.
+func removeTemp(path string) error {
+	temp, err := filepath.Glob(filepath.Join(path, tempPrefix+"*"))
+	if err != nil {
+		return fmt.Errorf("failed to list temp files: %w", err)
+	}
+
+	for _, file := range temp {
+		stat, err := os.Stat(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		if err == nil && time.Since(stat.ModTime()) < tempMaxAge {
+			continue
+		}
+
+		err = os.Remove(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove temp file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Get file header for data.
+func header(data []byte) []byte {
+	return sumHeader(crc32.Checksum(data, crcTable))
+}
+
+// Get file header for data checksum.
+func sumHeader(sum uint32) []byte {
+	return binary.BigEndian.AppendUint32(bytes.Clone(magic), sum)
+}
+
+// Flush dir entries to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if err != nil {
+		_ = dir.Close()
+		return err
 	}
 
-	return tmp, nil
+	return dir.Close()
 }
 
 func getRandomName() (string, error) {
@@ -1,16 +1,23 @@
 package storage
 
 import (
+	"context"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestStorage(t *testing.T) {
+	ctx := context.Background()
+
 	tfn := "testfile"
 
-	s, err := New("/tmp")
+	s, err := New("/tmp", false)
 	require.NoError(t, err)
 	require.DirExists(t, s.path)
 
@@ -18,7 +25,7 @@ func TestStorage(t *testing.T) {
 		data, err := os.ReadFile("../../examples/_gopher_original_1024x504.jpg")
 		require.NoError(t, err)
 
-		err = s.Write(tfn, data)
+		err = s.Write(ctx, tfn, data)
 		require.NoError(t, err)
 	})
 
@@ -26,11 +33,17 @@ func TestStorage(t *testing.T) {
 		orig, err := os.ReadFile("../../examples/_gopher_original_1024x504.jpg")
 		require.NoError(t, err)
 
-		data, err := s.Read(tfn)
+		data, err := s.Read(ctx, tfn)
 		require.NoError(t, err)
 		require.Equal(t, orig, data)
 	})
 
+	t.Run("list files", func(t *testing.T) {
+		files, err := s.List()
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{tfn: 64212}, files)
+	})
+
 	t.Run("delete file", func(t *testing.T) {
 		err := s.Delete(tfn)
 		require.NoError(t, err)
@@ -42,3 +55,268 @@ func TestStorage(t *testing.T) {
 		require.NoDirExists(t, s.path)
 	})
 }
+
+func TestPersistentStorage(t *testing.T) {
+	ctx := context.Background()
+
+	path := t.TempDir()
+
+	s, err := New(path, true)
+	require.NoError(t, err)
+	require.Equal(t, path, s.Path())
+
+	err = s.Write(ctx, "testfile", []byte("test"))
+	require.NoError(t, err)
+
+	// Reopen storage, file is still there.
+	s, err = New(path, true)
+	require.NoError(t, err)
+
+	data, err := s.Read(ctx, "testfile")
+	require.NoError(t, err)
+	require.Equal(t, []byte("test"), data)
+}
+
+func TestStorageIntegrity(t *testing.T) {
+	ctx := context.Background()
+
+	path := t.TempDir()
+
+	s, err := New(path, true, WithSync(true))
+	require.NoError(t, err)
+
+	t.Run("file permissions", func(t *testing.T) {
+		err := s.Write(ctx, "testfile", []byte("test"))
+		require.NoError(t, err)
+
+		stat, err := os.Stat(filepath.Join(path, "testfile"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(filePerm), stat.Mode().Perm())
+	})
+
+	t.Run("corrupted file", func(t *testing.T) {
+		err := s.Write(ctx, "testfile", []byte("test"))
+		require.NoError(t, err)
+
+		// Flip data byte.
+		file := filepath.Join(path, "testfile")
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		data[len(data)-1] ^= 0xff
+		require.NoError(t, os.WriteFile(file, data, filePerm))
+
+		_, err = s.Read(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		// Damaged file is not opened, so its data is never streamed.
+		_, err = s.Open(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		// Truncated file.
+		require.NoError(t, os.WriteFile(file, data[:headerSize+2], filePerm))
+
+		_, err = s.Read(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+	})
+
+	t.Run("damaged header", func(t *testing.T) {
+		err := s.Write(ctx, "testfile", []byte("test data"))
+		require.NoError(t, err)
+
+		// Flip magic byte.
+		file := filepath.Join(path, "testfile")
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		data[0] ^= 0xff
+		require.NoError(t, os.WriteFile(file, data, filePerm))
+
+		_, err = s.Read(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		_, err = s.Open(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		// File shorter than header.
+		require.NoError(t, os.WriteFile(file, []byte("abc"), filePerm))
+
+		_, err = s.Read(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		_, err = s.Open(ctx, "testfile")
+		require.ErrorIs(t, err, ErrCorrupted)
+
+		files, err := s.List()
+		require.NoError(t, err)
+		require.Zero(t, files["testfile"])
+		require.NoError(t, s.Delete("testfile"))
+	})
+
+	t.Run("open file", func(t *testing.T) {
+		err := s.Write(ctx, "testfile", []byte("test data"))
+		require.NoError(t, err)
+
+		f, err := s.Open(ctx, "testfile")
+		require.NoError(t, err)
+		defer f.Close()
+
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, []byte("test data"), data)
+
+		// Read range.
+		_, err = f.Seek(5, io.SeekStart)
+		require.NoError(t, err)
+
+		data, err = io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, []byte("data"), data)
+
+		_, err = s.Open(ctx, "missing")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("interrupted write", func(t *testing.T) {
+		err := os.WriteFile(filepath.Join(path, tempPrefix+"123"), []byte("te"), filePerm)
+		require.NoError(t, err)
+
+		files, err := s.List()
+		require.NoError(t, err)
+		require.NotContains(t, files, tempPrefix+"123")
+
+		// Recent temp files may be written by other process.
+		_, err = New(path, true)
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(path, tempPrefix+"123"))
+
+		// Abandoned temp files are removed on open.
+		old := time.Now().Add(-2 * tempMaxAge)
+		require.NoError(t, os.Chtimes(filepath.Join(path, tempPrefix+"123"), old, old))
+
+		_, err = New(path, true)
+		require.NoError(t, err)
+		require.NoFileExists(t, filepath.Join(path, tempPrefix+"123"))
+	})
+}
+
+func TestStorageFanOut(t *testing.T) {
+	ctx := context.Background()
+
+	path := t.TempDir()
+	name := "abcdef0123"
+
+	s, err := New(path, true)
+	require.NoError(t, err)
+
+	err = s.Write(ctx, name, []byte("test"))
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(path, name))
+
+	t.Run("migrate to fan-out layout", func(t *testing.T) {
+		s, err := New(path, true, WithFanOut(2))
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(path, "ab", "cd", name))
+		require.NoFileExists(t, filepath.Join(path, name))
+
+		data, err := s.Read(ctx, name)
+		require.NoError(t, err)
+		require.Equal(t, []byte("test"), data)
+
+		files, err := s.List()
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{name: 4}, files)
+
+		err = s.Write(ctx, "0123", []byte("test"))
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(path, "01", "23", "0123"))
+
+		// Short names are kept in root.
+		err = s.Write(ctx, "a", []byte("test"))
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(path, "a"))
+	})
+
+	t.Run("migrate to flat layout", func(t *testing.T) {
+		s, err := New(path, true)
+		require.NoError(t, err)
+		require.FileExists(t, filepath.Join(path, name))
+		require.NoDirExists(t, filepath.Join(path, "ab"))
+
+		files, err := s.List()
+		require.NoError(t, err)
+		require.Len(t, files, 3)
+
+		require.NoError(t, s.Delete(name))
+	})
+}
+
+func TestBackends(t *testing.T) {
+	ctx := context.Background()
+
+	fs, err := New(t.TempDir(), true, WithFanOut(1))
+	require.NoError(t, err)
+
+	log, err := NewLog(t.TempDir(), true, LogOptions{})
+	require.NoError(t, err)
+
+	s3, err := NewS3(S3Options{
+		Endpoint:  newFakeS3(t, "bucket").URL,
+		Bucket:    "bucket",
+		Prefix:    "cache",
+		AccessKey: "key",
+		SecretKey: "secret",
+	}, false)
+	require.NoError(t, err)
+
+	backends := map[string]interface {
+		Write(ctx context.Context, name string, data []byte) error
+		WriteFrom(ctx context.Context, name string, r io.Reader) (int64, error)
+		Read(ctx context.Context, name string) ([]byte, error)
+		Open(ctx context.Context, name string) (io.ReadSeekCloser, error)
+		Delete(name string) error
+		List() (map[string]int64, error)
+		Clean() error
+	}{
+		"fs":     fs,
+		"memory": NewMemory(),
+		"log":    log,
+		"s3":     s3,
+	}
+
+	for name, s := range backends {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, s.Write(ctx, "file1", []byte("test")))
+			require.NoError(t, s.Write(ctx, "file2", []byte("test2")))
+			require.NoError(t, s.Write(ctx, "file1", []byte("test1")))
+
+			n, err := s.WriteFrom(ctx, "file3", strings.NewReader("test3"))
+			require.NoError(t, err)
+			require.Equal(t, int64(5), n)
+
+			data, err := s.Read(ctx, "file3")
+			require.NoError(t, err)
+			require.Equal(t, []byte("test3"), data)
+
+			data, err = s.Read(ctx, "file1")
+			require.NoError(t, err)
+			require.Equal(t, []byte("test1"), data)
+
+			f, err := s.Open(ctx, "file2")
+			require.NoError(t, err)
+			data, err = io.ReadAll(f)
+			require.NoError(t, err)
+			require.Equal(t, []byte("test2"), data)
+			require.NoError(t, f.Close())
+
+			files, err := s.List()
+			require.NoError(t, err)
+			require.Equal(t, map[string]int64{"file1": 5, "file2": 5, "file3": 5}, files)
+
+			require.NoError(t, s.Delete("file1"))
+
+			_, err = s.Read(ctx, "file1")
+			require.ErrorIs(t, err, os.ErrNotExist)
+
+			require.NoError(t, s.Clean())
+		})
+	}
+}
@@ -29,11 +29,11 @@ func (p *ProxySuite) SetupSuite() {
 func (p *ProxySuite) TestImageNotFound() {
 	resp, err := p.client.Get(proxy + "fill/100/200/nginx/fakeimage.jpg")
 	p.Require().NoError(err)
-	p.Require().Equal(502, resp.StatusCode)
+	p.Require().Equal(404, resp.StatusCode)
 
 	body, err := getResponseBodyString(*resp)
 	p.Require().NoError(err)
-	p.Require().Equal("remote server return: 404 Not Found\n", body)
+	p.Require().JSONEq(`{"status":404,"error":"remote server return: 404 Not Found"}`, body)
 
 	resp.Body.Close()
 }
@@ -57,7 +57,7 @@ func (p *ProxySuite) TestRemoteServerError() {
 
 	body, err := getResponseBodyString(*resp)
 	p.Require().NoError(err)
-	p.Require().Equal(body, "remote server return: 503 Service Temporarily Unavailable\n")
+	p.Require().JSONEq(`{"status":502,"error":"remote server return: 503 Service Temporarily Unavailable"}`, body)
 
 	resp.Body.Close()
 }
@@ -65,11 +65,11 @@ func (p *ProxySuite) TestRemoteServerError() {
 func (p *ProxySuite) TestInvalidFileType() {
 	resp, err := p.client.Get(proxy + "fill/100/200/nginx/text.file")
 	p.Require().NoError(err)
-	p.Require().Equal(502, resp.StatusCode)
+	p.Require().Equal(415, resp.StatusCode)
 
 	body, err := getResponseBodyString(*resp)
 	p.Require().NoError(err)
-	p.Require().Equal(body, "invalid file type\n")
+	p.Require().JSONEq(`{"status":415,"error":"invalid file type"}`, body)
 
 	resp.Body.Close()
 }
@@ -77,7 +77,7 @@ func (p *ProxySuite) TestInvalidFileType() {
 func (p *ProxySuite) TestInvalidImageSize() {
 	resp, err := p.client.Get(proxy + "fill/3000/5000/nginx/_gopher_original_1024x504.jpg")
 	p.Require().NoError(err)
-	p.Require().Equal(502, resp.StatusCode)
+	p.Require().Equal(422, resp.StatusCode)
 
 	body, err := getResponseBodyString(*resp)
 	p.Require().NoError(err)
@@ -86,6 +86,15 @@ func (p *ProxySuite) TestInvalidImageSize() {
 	resp.Body.Close()
 }
 
+func (p *ProxySuite) TestInvalidParameters() {
+	resp, err := p.client.Get(proxy + "fill/abc/200/nginx/_gopher_original_1024x504.jpg")
+	p.Require().NoError(err)
+	p.Require().Equal(400, resp.StatusCode)
+	p.Require().Equal("application/json", resp.Header.Get("Content-Type"))
+
+	resp.Body.Close()
+}
+
 func (p *ProxySuite) TestCustomHeaderPass() {
 	ctx := context.Background()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxy+"fill/100/200/nginx/protected/_gopher_original_1024x504.jpg", nil)
@@ -107,7 +116,39 @@ func (p *ProxySuite) TestSuccessfullProcessing() {
 	p.Require().Equal(200, resp.StatusCode)
 	p.Require().NoError(err)
 	p.Require().NotNil(resp.Body)
+	p.Require().Equal("image/jpeg", resp.Header.Get("Content-Type"))
+	p.Require().NotEmpty(resp.Header.Get("ETag"))
+	p.Require().NotEmpty(resp.Header.Get("Last-Modified"))
+	p.Require().Contains(resp.Header.Get("Cache-Control"), "max-age=")
+
+	resp.Body.Close()
+}
 
+func (p *ProxySuite) TestNotModified() {
+	resp, err := p.client.Get(proxy + "fill/120/120/nginx/_gopher_original_1024x504.jpg")
+	p.Require().NoError(err)
+	p.Require().Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	p.Require().NotEmpty(etag)
+
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, proxy+"fill/120/120/nginx/_gopher_original_1024x504.jpg", nil)
+	p.Require().NoError(err)
+	req.Header.Set("If-None-Match", etag)
+
+	resp, err = p.client.Do(req)
+	p.Require().NoError(err)
+	p.Require().Equal(304, resp.StatusCode)
+	p.Require().Equal(etag, resp.Header.Get("ETag"))
+	resp.Body.Close()
+
+	req.Header.Del("If-None-Match")
+	req.Header.Set("If-Modified-Since", resp.Header.Get("Last-Modified"))
+
+	resp, err = p.client.Do(req)
+	p.Require().NoError(err)
+	p.Require().Equal(304, resp.StatusCode)
 	resp.Body.Close()
 }
 